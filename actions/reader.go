@@ -0,0 +1,175 @@
+package actions
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	polytopiamapmodel "github.com/samuelyuan/polytopiamapmodelgo"
+)
+
+const (
+	ActionTypeBuild              = 1
+	ActionTypeAttack             = 2
+	ActionTypeRecover            = 3
+	ActionTypeTrain              = 5
+	ActionTypeMove               = 6
+	ActionTypeCaptureCity        = 7
+	ActionTypeResearch           = 8
+	ActionTypeDestroyImprovement = 9
+	ActionTypeCityReward         = 11
+	ActionTypePromote            = 13
+	ActionTypeExamineRuins       = 14
+	ActionTypeEndTurn            = 15
+	ActionTypeUpgrade            = 16
+	ActionTypeCityLevelUp        = 21
+
+	// An end turn action from this player id starts a new turn for everyone
+	EndOfRoundPlayerId = 255
+)
+
+var (
+	// Action types that aren't decoded yet, mapped to their size in bytes
+	unknownActionSizes = map[int]int{
+		4:  9,
+		17: 9,
+		18: 9,
+		20: 1,
+		24: 9,
+		25: 9,
+		27: 10,
+		28: 3,
+		29: 10,
+		30: 10,
+	}
+)
+
+type Action struct {
+	Index    int
+	Turn     int
+	Type     int
+	PlayerId int
+	// Pointer to one of the polytopiamapmodel action types, or the raw bytes if the action type isn't decoded
+	Data interface{}
+}
+
+func newActionData(actionType int) interface{} {
+	switch actionType {
+	case ActionTypeBuild:
+		return &polytopiamapmodel.ActionBuild{}
+	case ActionTypeAttack:
+		return &polytopiamapmodel.ActionAttack{}
+	case ActionTypeRecover:
+		return &polytopiamapmodel.ActionRecover{}
+	case ActionTypeTrain:
+		return &polytopiamapmodel.ActionTrain{}
+	case ActionTypeMove:
+		return &polytopiamapmodel.ActionMove{}
+	case ActionTypeCaptureCity:
+		return &polytopiamapmodel.ActionCaptureCity{}
+	case ActionTypeResearch:
+		return &polytopiamapmodel.ActionResearch{}
+	case ActionTypeDestroyImprovement:
+		return &polytopiamapmodel.ActionDestroyImprovement{}
+	case ActionTypeCityReward:
+		return &polytopiamapmodel.ActionCityReward{}
+	case ActionTypePromote:
+		return &polytopiamapmodel.ActionPromote{}
+	case ActionTypeExamineRuins:
+		return &polytopiamapmodel.ActionExamineRuins{}
+	case ActionTypeEndTurn:
+		return &polytopiamapmodel.ActionEndTurn{}
+	case ActionTypeUpgrade:
+		return &polytopiamapmodel.ActionUpgrade{}
+	case ActionTypeCityLevelUp:
+		return &polytopiamapmodel.ActionCityLevelUp{}
+	}
+	return nil
+}
+
+func ReadActions(streamReader io.Reader) ([]Action, error) {
+	numActions := uint16(0)
+	if err := binary.Read(streamReader, binary.LittleEndian, &numActions); err != nil {
+		return nil, fmt.Errorf("failed to read number of actions: %w", err)
+	}
+
+	allActions := make([]Action, 0, int(numActions))
+	turn := 1
+	for i := 0; i < int(numActions); i++ {
+		actionType := uint16(0)
+		if err := binary.Read(streamReader, binary.LittleEndian, &actionType); err != nil {
+			return nil, fmt.Errorf("failed to read type of action %v: %w", i, err)
+		}
+
+		data := newActionData(int(actionType))
+		size := 0
+		if data != nil {
+			size = binary.Size(data)
+		} else if unknownSize, ok := unknownActionSizes[int(actionType)]; ok {
+			size = unknownSize
+		} else {
+			return nil, fmt.Errorf("unknown action type %v at action %v", actionType, i)
+		}
+
+		buffer := make([]byte, size)
+		if _, err := io.ReadFull(streamReader, buffer); err != nil {
+			return nil, fmt.Errorf("failed to read action %v with type %v: %w", i, actionType, err)
+		}
+		if data != nil {
+			if err := binary.Read(bytes.NewReader(buffer), binary.LittleEndian, data); err != nil {
+				return nil, fmt.Errorf("failed to decode action %v with type %v: %w", i, actionType, err)
+			}
+		} else {
+			data = buffer
+		}
+
+		// Every action starts with the id of the player who performed it
+		allActions = append(allActions, Action{
+			Index:    i,
+			Turn:     turn,
+			Type:     int(actionType),
+			PlayerId: int(buffer[0]),
+			Data:     data,
+		})
+
+		if endTurn, ok := data.(*polytopiamapmodel.ActionEndTurn); ok && endTurn.PlayerId == EndOfRoundPlayerId {
+			turn++
+		}
+	}
+	return allActions, nil
+}
+
+// The save model only keeps the city captures, so the full action list is read from the same decompressed
+// contents the save was parsed from. The actions start after the current player data and two unknown bytes.
+func ReadActionsFromDecompressedContents(decompressedContents []byte, saveData *polytopiamapmodel.PolytopiaSaveOutput) ([]Action, error) {
+	allPlayersEnd, ok := saveData.FileOffsetMap["AllPlayersEnd"]
+	if !ok {
+		return nil, fmt.Errorf("save data doesn't have the offset of the player list")
+	}
+
+	actionsStart := allPlayersEnd + 2
+	if actionsStart > len(decompressedContents) {
+		return nil, fmt.Errorf("action list offset %v is past the end of the file", actionsStart)
+	}
+	return ReadActions(bytes.NewReader(decompressedContents[actionsStart:]))
+}
+
+// Older saves or files that fail to parse can still replay the city captures
+func BuildCaptureActions(saveData *polytopiamapmodel.PolytopiaSaveOutput) []Action {
+	allActions := make([]Action, 0)
+	for turn := 1; turn <= saveData.MaxTurn; turn++ {
+		captureEvents := saveData.TurnCaptureMap[turn]
+		for eventNum := 0; eventNum < len(captureEvents); eventNum++ {
+			captureEvent := captureEvents[eventNum]
+			allActions = append(allActions, Action{
+				Index:    len(allActions),
+				Turn:     turn,
+				Type:     ActionTypeCaptureCity,
+				PlayerId: int(captureEvent.PlayerId),
+				Data:     &captureEvent,
+			})
+		}
+	}
+	return allActions
+}
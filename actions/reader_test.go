@@ -0,0 +1,113 @@
+package actions
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	polytopiamapmodel "github.com/samuelyuan/polytopiamapmodelgo"
+)
+
+// Serialize the actions in the same layout as the save file
+func buildActionBytes(t *testing.T, actionTypes []uint16, actionData []interface{}) []byte {
+	var buffer bytes.Buffer
+	binary.Write(&buffer, binary.LittleEndian, uint16(len(actionTypes)))
+	for i, actionType := range actionTypes {
+		binary.Write(&buffer, binary.LittleEndian, actionType)
+		if data, ok := actionData[i].([]byte); ok {
+			buffer.Write(data)
+		} else if err := binary.Write(&buffer, binary.LittleEndian, actionData[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buffer.Bytes()
+}
+
+func TestReadActions(t *testing.T) {
+	build := &polytopiamapmodel.ActionBuild{PlayerId: 1, ImprovementType: 5, Coordinates: [2]uint32{3, 4}}
+	move := &polytopiamapmodel.ActionMove{PlayerId: 1, OldPosition: [2]uint32{1, 2}, NewPosition: [2]uint32{2, 2}, UnitId: 7}
+	unknown := []byte{2, 0, 0, 0, 0, 0, 0, 0, 0}
+	playerEndTurn := &polytopiamapmodel.ActionEndTurn{PlayerId: 1}
+	roundEndTurn := &polytopiamapmodel.ActionEndTurn{PlayerId: EndOfRoundPlayerId}
+	capture := &polytopiamapmodel.ActionCaptureCity{PlayerId: 2, UnitId: 9, Coordinates: [2]uint32{5, 6}}
+
+	inputByteData := buildActionBytes(t,
+		[]uint16{ActionTypeBuild, ActionTypeMove, 4, ActionTypeEndTurn, ActionTypeEndTurn, ActionTypeCaptureCity},
+		[]interface{}{build, move, unknown, playerEndTurn, roundEndTurn, capture})
+	result, err := ReadActions(bytes.NewReader(inputByteData))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Action{
+		{Index: 0, Turn: 1, Type: ActionTypeBuild, PlayerId: 1, Data: build},
+		{Index: 1, Turn: 1, Type: ActionTypeMove, PlayerId: 1, Data: move},
+		{Index: 2, Turn: 1, Type: 4, PlayerId: 2, Data: unknown},
+		{Index: 3, Turn: 1, Type: ActionTypeEndTurn, PlayerId: 1, Data: playerEndTurn},
+		{Index: 4, Turn: 1, Type: ActionTypeEndTurn, PlayerId: EndOfRoundPlayerId, Data: roundEndTurn},
+		{Index: 5, Turn: 2, Type: ActionTypeCaptureCity, PlayerId: 2, Data: capture},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("ReadActions = %+v, expected %+v", result, expected)
+	}
+}
+
+func TestReadActionsUnknownType(t *testing.T) {
+	inputByteData := buildActionBytes(t, []uint16{99}, []interface{}{[]byte{1}})
+	if _, err := ReadActions(bytes.NewReader(inputByteData)); err == nil {
+		t.Fatal("expected an error for an unknown action type")
+	}
+}
+
+func TestReadActionsTruncated(t *testing.T) {
+	inputByteData := buildActionBytes(t,
+		[]uint16{ActionTypeMove},
+		[]interface{}{&polytopiamapmodel.ActionMove{PlayerId: 1}})
+	if _, err := ReadActions(bytes.NewReader(inputByteData[:len(inputByteData)-1])); err == nil {
+		t.Fatal("expected an error for a truncated action")
+	}
+}
+
+func TestReadActionsFromDecompressedContents(t *testing.T) {
+	actionByteData := buildActionBytes(t,
+		[]uint16{ActionTypeResearch},
+		[]interface{}{&polytopiamapmodel.ActionResearch{PlayerId: 3, TechType: 12}})
+	// Player data, then the two unknown bytes before the actions
+	decompressedContents := append([]byte{0xAA, 0xBB, 0xCC, 0, 0}, actionByteData...)
+	saveData := &polytopiamapmodel.PolytopiaSaveOutput{FileOffsetMap: map[string]int{"AllPlayersEnd": 3}}
+
+	result, err := ReadActionsFromDecompressedContents(decompressedContents, saveData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Action{
+		{Index: 0, Turn: 1, Type: ActionTypeResearch, PlayerId: 3, Data: &polytopiamapmodel.ActionResearch{PlayerId: 3, TechType: 12}},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("ReadActionsFromDecompressedContents = %+v, expected %+v", result, expected)
+	}
+
+	saveData.FileOffsetMap["AllPlayersEnd"] = len(decompressedContents)
+	if _, err := ReadActionsFromDecompressedContents(decompressedContents, saveData); err == nil {
+		t.Fatal("expected an error for an offset past the end of the contents")
+	}
+	if _, err := ReadActionsFromDecompressedContents(decompressedContents, &polytopiamapmodel.PolytopiaSaveOutput{}); err == nil {
+		t.Fatal("expected an error for a save without the player list offset")
+	}
+}
+
+func TestBuildCaptureActions(t *testing.T) {
+	capture := polytopiamapmodel.ActionCaptureCity{PlayerId: 2, UnitId: 9, Coordinates: [2]uint32{5, 6}}
+	saveData := &polytopiamapmodel.PolytopiaSaveOutput{
+		MaxTurn:        3,
+		TurnCaptureMap: map[int][]polytopiamapmodel.ActionCaptureCity{2: {capture}},
+	}
+	result := BuildCaptureActions(saveData)
+	expected := []Action{
+		{Index: 0, Turn: 2, Type: ActionTypeCaptureCity, PlayerId: 2, Data: &capture},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Fatalf("BuildCaptureActions = %+v, expected %+v", result, expected)
+	}
+}
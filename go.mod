@@ -3,12 +3,11 @@ module github.com/samuelyuan/PolytopiaMapImage
 go 1.23.2
 
 require (
+	github.com/HugoSmits86/nativewebp v0.9.3
 	github.com/fogleman/gg v1.3.0
 	github.com/golang/freetype v0.0.0-20170609003504-e2365dfdc4a0
+	github.com/samuelyuan/polytopiamapmodelgo v0.0.0-20241224002108-637d0b5713c0
 	golang.org/x/image v0.22.0
 )
 
-require (
-	github.com/pierrec/lz4/v4 v4.1.22 // indirect
-	github.com/samuelyuan/polytopiamapmodelgo v0.0.0-20241224002108-637d0b5713c0 // indirect
-)
+require github.com/pierrec/lz4/v4 v4.1.22 // indirect
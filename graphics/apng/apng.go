@@ -0,0 +1,260 @@
+// Package apng writes animated PNG files.
+// Every frame is stored as 8-bit RGBA so that the frames always match the color type in the header.
+package apng
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"io"
+)
+
+const (
+	colorTypeRGBA = 6
+	bitDepth      = 8
+
+	filterNone    = 0
+	filterSub     = 1
+	filterUp      = 2
+	filterAverage = 3
+	filterPaeth   = 4
+
+	DisposeNone       = 0
+	DisposeBackground = 1
+	DisposePrevious   = 2
+
+	BlendSource = 0
+	BlendOver   = 1
+)
+
+var (
+	pngSignature = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}
+)
+
+type Encoder struct {
+	w         io.Writer
+	numFrames int
+	loopCount int
+
+	width      int
+	height     int
+	frameCount int
+	sequence   uint32
+	err        error
+}
+
+// The number of frames must be known up front because it is stored in the header.
+// A loop count of zero repeats the animation forever.
+func NewEncoder(w io.Writer, numFrames int, loopCount int) *Encoder {
+	return &Encoder{
+		w:         w,
+		numFrames: numFrames,
+		loopCount: loopCount,
+	}
+}
+
+func (e *Encoder) writeChunk(chunkType string, data []byte) {
+	if e.err != nil {
+		return
+	}
+
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(data)))
+	copy(header[4:8], chunkType)
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:8])
+	crc.Write(data)
+	footer := make([]byte, 4)
+	binary.BigEndian.PutUint32(footer, crc.Sum32())
+
+	for _, b := range [][]byte{header, data, footer} {
+		if _, err := e.w.Write(b); err != nil {
+			e.err = err
+			return
+		}
+	}
+}
+
+func (e *Encoder) writeHeader() {
+	if _, err := e.w.Write(pngSignature); err != nil {
+		e.err = err
+		return
+	}
+
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(e.width))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(e.height))
+	ihdr[8] = bitDepth
+	ihdr[9] = colorTypeRGBA
+	// compression, filter and interlace methods are all zero
+	e.writeChunk("IHDR", ihdr)
+
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl[0:4], uint32(e.numFrames))
+	binary.BigEndian.PutUint32(actl[4:8], uint32(e.loopCount))
+	e.writeChunk("acTL", actl)
+}
+
+func (e *Encoder) writeFrameControl(bounds image.Rectangle, delayNum uint16, delayDen uint16, disposeOp byte, blendOp byte) {
+	fctl := make([]byte, 26)
+	binary.BigEndian.PutUint32(fctl[0:4], e.sequence)
+	binary.BigEndian.PutUint32(fctl[4:8], uint32(bounds.Dx()))
+	binary.BigEndian.PutUint32(fctl[8:12], uint32(bounds.Dy()))
+	binary.BigEndian.PutUint32(fctl[12:16], uint32(bounds.Min.X))
+	binary.BigEndian.PutUint32(fctl[16:20], uint32(bounds.Min.Y))
+	binary.BigEndian.PutUint16(fctl[20:22], delayNum)
+	binary.BigEndian.PutUint16(fctl[22:24], delayDen)
+	fctl[24] = disposeOp
+	fctl[25] = blendOp
+	e.sequence++
+	e.writeChunk("fcTL", fctl)
+}
+
+// Write a frame shown for delayNum / delayDen seconds.
+// The first frame sets the canvas size. Later frames can be smaller and are placed at their bounds.
+func (e *Encoder) WriteFrame(img image.Image, delayNum uint16, delayDen uint16) error {
+	return e.WriteFrameWithOptions(img, delayNum, delayDen, DisposeNone, BlendSource)
+}
+
+func (e *Encoder) WriteFrameWithOptions(img image.Image, delayNum uint16, delayDen uint16, disposeOp byte, blendOp byte) error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.frameCount >= e.numFrames {
+		return fmt.Errorf("apng: expected %v frames but got more", e.numFrames)
+	}
+
+	bounds := img.Bounds()
+	if e.frameCount == 0 {
+		if bounds.Min != (image.Point{}) {
+			return errors.New("apng: first frame must start at the origin")
+		}
+		e.width = bounds.Dx()
+		e.height = bounds.Dy()
+		e.writeHeader()
+	} else if !bounds.In(image.Rect(0, 0, e.width, e.height)) {
+		return fmt.Errorf("apng: frame %v with bounds %v is outside of the canvas", e.frameCount, bounds)
+	}
+
+	imageData, err := compressImage(img)
+	if err != nil {
+		return err
+	}
+
+	e.writeFrameControl(bounds, delayNum, delayDen, disposeOp, blendOp)
+	if e.frameCount == 0 {
+		// The first frame is also the default image for viewers without animation support
+		e.writeChunk("IDAT", imageData)
+	} else {
+		fdat := make([]byte, 4+len(imageData))
+		binary.BigEndian.PutUint32(fdat[0:4], e.sequence)
+		copy(fdat[4:], imageData)
+		e.sequence++
+		e.writeChunk("fdAT", fdat)
+	}
+	e.frameCount++
+	return e.err
+}
+
+func (e *Encoder) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.frameCount != e.numFrames {
+		return fmt.Errorf("apng: expected %v frames but got %v", e.numFrames, e.frameCount)
+	}
+	e.writeChunk("IEND", nil)
+	return e.err
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func paeth(a uint8, b uint8, c uint8) uint8 {
+	p := int(a) + int(b) - int(c)
+	pa := abs(p - int(a))
+	pb := abs(p - int(b))
+	pc := abs(p - int(c))
+	if pa <= pb && pa <= pc {
+		return a
+	} else if pb <= pc {
+		return b
+	}
+	return c
+}
+
+// Filter a row with each filter type and keep the one with the smallest sum of absolute values,
+// which is the heuristic recommended by the PNG specification.
+func filterRow(current []byte, previous []byte, filtered [][]byte) []byte {
+	const bytesPerPixel = 4
+	for i := 0; i < len(current); i++ {
+		var left, upLeft uint8
+		if i >= bytesPerPixel {
+			left = current[i-bytesPerPixel]
+			upLeft = previous[i-bytesPerPixel]
+		}
+		up := previous[i]
+
+		filtered[filterNone][i+1] = current[i]
+		filtered[filterSub][i+1] = current[i] - left
+		filtered[filterUp][i+1] = current[i] - up
+		filtered[filterAverage][i+1] = current[i] - uint8((int(left)+int(up))/2)
+		filtered[filterPaeth][i+1] = current[i] - paeth(left, up, upLeft)
+	}
+
+	best := filtered[filterNone]
+	bestSum := -1
+	for filterType := 0; filterType < len(filtered); filterType++ {
+		sum := 0
+		for _, b := range filtered[filterType][1:] {
+			sum += abs(int(int8(b)))
+		}
+		if bestSum < 0 || sum < bestSum {
+			best = filtered[filterType]
+			bestSum = sum
+		}
+	}
+	return best
+}
+
+func compressImage(img image.Image) ([]byte, error) {
+	bounds := img.Bounds()
+	nrgba, ok := img.(*image.NRGBA)
+	if !ok {
+		nrgba = image.NewNRGBA(bounds)
+		draw.Draw(nrgba, bounds, img, bounds.Min, draw.Src)
+	}
+
+	rowSize := bounds.Dx() * 4
+	filtered := make([][]byte, 5)
+	for filterType := 0; filterType < len(filtered); filterType++ {
+		filtered[filterType] = make([]byte, rowSize+1)
+		filtered[filterType][0] = byte(filterType)
+	}
+	previous := make([]byte, rowSize)
+
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		start := nrgba.PixOffset(bounds.Min.X, y)
+		current := nrgba.Pix[start : start+rowSize]
+		if _, err := zw.Write(filterRow(current, previous, filtered)); err != nil {
+			return nil, fmt.Errorf("apng: failed to compress frame: %w", err)
+		}
+		previous = current
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("apng: failed to compress frame: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,183 @@
+package apng
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"testing"
+
+	"github.com/samuelyuan/PolytopiaMapImage/graphics/internal/imagetest"
+)
+
+type pngChunk struct {
+	chunkType string
+	data      []byte
+}
+
+// Split the file into chunks, checking the signature and the CRC of every chunk
+func readChunks(t *testing.T, data []byte) []pngChunk {
+	if !bytes.HasPrefix(data, pngSignature) {
+		t.Fatal("missing PNG signature")
+	}
+	chunks := make([]pngChunk, 0)
+	for offset := len(pngSignature); offset < len(data); {
+		if offset+12 > len(data) {
+			t.Fatalf("truncated chunk at offset %v", offset)
+		}
+		length := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+		end := offset + 12 + length
+		if end > len(data) {
+			t.Fatalf("chunk at offset %v with length %v is past the end of the file", offset, length)
+		}
+		chunkType := string(data[offset+4 : offset+8])
+		chunkData := data[offset+8 : offset+8+length]
+		if crc := crc32.ChecksumIEEE(data[offset+4 : offset+8+length]); crc != binary.BigEndian.Uint32(data[end-4:end]) {
+			t.Fatalf("%v chunk has the wrong CRC", chunkType)
+		}
+		chunks = append(chunks, pngChunk{chunkType: chunkType, data: chunkData})
+		offset = end
+	}
+	return chunks
+}
+
+// Decode the frame data as a standalone PNG with the frame size
+func decodeFrameData(t *testing.T, width int, height int, imageData []byte) image.Image {
+	var buf bytes.Buffer
+	e := &Encoder{w: &buf}
+	buf.Write(pngSignature)
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:4], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:8], uint32(height))
+	ihdr[8] = bitDepth
+	ihdr[9] = colorTypeRGBA
+	e.writeChunk("IHDR", ihdr)
+	e.writeChunk("IDAT", imageData)
+	e.writeChunk("IEND", nil)
+
+	img, err := png.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	frames := []image.Image{
+		imagetest.BuildFrame(image.Rect(0, 0, 5, 4), 0),
+		imagetest.BuildFrame(image.Rect(1, 2, 4, 4), 7),
+		imagetest.BuildFrame(image.Rect(0, 0, 5, 4), 13),
+	}
+	delays := []uint16{100, 20, 1000}
+
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf, len(frames), 2)
+	for i, frame := range frames {
+		if err := encoder.WriteFrame(frame, delays[i], 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Viewers without animation support show the first frame
+	defaultImage, err := png.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	imagetest.AssertSamePixels(t, "default image", frames[0], defaultImage)
+
+	chunks := readChunks(t, buf.Bytes())
+	expectedTypes := []string{"IHDR", "acTL", "fcTL", "IDAT", "fcTL", "fdAT", "fcTL", "fdAT", "IEND"}
+	if len(chunks) != len(expectedTypes) {
+		t.Fatalf("got %v chunks, expected %v", len(chunks), len(expectedTypes))
+	}
+	for i, chunk := range chunks {
+		if chunk.chunkType != expectedTypes[i] {
+			t.Fatalf("chunk %v is %v, expected %v", i, chunk.chunkType, expectedTypes[i])
+		}
+	}
+
+	actl := chunks[1].data
+	if numFrames := binary.BigEndian.Uint32(actl[0:4]); numFrames != uint32(len(frames)) {
+		t.Fatalf("acTL has %v frames, expected %v", numFrames, len(frames))
+	}
+	if loopCount := binary.BigEndian.Uint32(actl[4:8]); loopCount != 2 {
+		t.Fatalf("acTL loop count is %v, expected 2", loopCount)
+	}
+
+	// fcTL and fdAT chunks share one sequence that starts at zero and has no gaps
+	expectedSequence := uint32(0)
+	frameIndex := 0
+	for _, chunk := range chunks {
+		switch chunk.chunkType {
+		case "fcTL":
+			if sequence := binary.BigEndian.Uint32(chunk.data[0:4]); sequence != expectedSequence {
+				t.Fatalf("fcTL has sequence number %v, expected %v", sequence, expectedSequence)
+			}
+			expectedSequence++
+
+			bounds := frames[frameIndex].Bounds()
+			width := binary.BigEndian.Uint32(chunk.data[4:8])
+			height := binary.BigEndian.Uint32(chunk.data[8:12])
+			x := binary.BigEndian.Uint32(chunk.data[12:16])
+			y := binary.BigEndian.Uint32(chunk.data[16:20])
+			if image.Rect(int(x), int(y), int(x+width), int(y+height)) != bounds {
+				t.Fatalf("frame %v has bounds %v,%v %vx%v, expected %v", frameIndex, x, y, width, height, bounds)
+			}
+			if delayNum := binary.BigEndian.Uint16(chunk.data[20:22]); delayNum != delays[frameIndex] {
+				t.Fatalf("frame %v has delay %v, expected %v", frameIndex, delayNum, delays[frameIndex])
+			}
+			if delayDen := binary.BigEndian.Uint16(chunk.data[22:24]); delayDen != 100 {
+				t.Fatalf("frame %v has delay denominator %v, expected 100", frameIndex, delayDen)
+			}
+			frameIndex++
+		case "fdAT":
+			if sequence := binary.BigEndian.Uint32(chunk.data[0:4]); sequence != expectedSequence {
+				t.Fatalf("fdAT has sequence number %v, expected %v", sequence, expectedSequence)
+			}
+			expectedSequence++
+
+			frame := frames[frameIndex-1]
+			frameImage := decodeFrameData(t, frame.Bounds().Dx(), frame.Bounds().Dy(), chunk.data[4:])
+			imagetest.AssertSamePixels(t, "frame", frame, frameImage)
+		}
+	}
+}
+
+func TestFrameCountMismatch(t *testing.T) {
+	frame := imagetest.BuildFrame(image.Rect(0, 0, 2, 2), 0)
+
+	encoder := NewEncoder(&bytes.Buffer{}, 1, 0)
+	if err := encoder.WriteFrame(frame, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.WriteFrame(frame, 1, 1); err == nil {
+		t.Fatal("expected an error for more frames than in the header")
+	}
+
+	encoder = NewEncoder(&bytes.Buffer{}, 2, 0)
+	if err := encoder.WriteFrame(frame, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.Close(); err == nil {
+		t.Fatal("expected an error for fewer frames than in the header")
+	}
+}
+
+func TestFrameOutsideCanvas(t *testing.T) {
+	encoder := NewEncoder(&bytes.Buffer{}, 2, 0)
+	if err := encoder.WriteFrame(imagetest.BuildFrame(image.Rect(1, 1, 3, 3), 0), 1, 1); err == nil {
+		t.Fatal("expected an error for a first frame that doesn't start at the origin")
+	}
+
+	encoder = NewEncoder(&bytes.Buffer{}, 2, 0)
+	if err := encoder.WriteFrame(imagetest.BuildFrame(image.Rect(0, 0, 2, 2), 0), 1, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.WriteFrame(imagetest.BuildFrame(image.Rect(1, 1, 3, 3), 0), 1, 1); err == nil {
+		t.Fatal("expected an error for a frame outside of the canvas")
+	}
+}
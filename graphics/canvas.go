@@ -0,0 +1,90 @@
+package graphics
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/freetype/truetype"
+	polytopiamapmodel "github.com/samuelyuan/polytopiamapmodelgo"
+	"golang.org/x/image/font"
+)
+
+// The part of gg.Context used to draw the map, so the same drawing code
+// can rasterize the map with gg or write it out as an SVG
+type canvas interface {
+	MoveTo(x float64, y float64)
+	LineTo(x float64, y float64)
+	ClosePath()
+	DrawLine(x1 float64, y1 float64, x2 float64, y2 float64)
+	DrawRectangle(x float64, y float64, w float64, h float64)
+	DrawCircle(x float64, y float64, r float64)
+	DrawEllipse(x float64, y float64, rx float64, ry float64)
+	DrawRegularPolygon(n int, x float64, y float64, r float64, rotation float64)
+
+	SetRGB255(r int, g int, b int)
+	SetLineWidth(lineWidth float64)
+	SetDash(dashes ...float64)
+	Fill()
+	FillPreserve()
+	Stroke()
+
+	SetFontFace(fontFace font.Face)
+	FontHeight() float64
+	MeasureString(s string) (float64, float64)
+	DrawStringAnchored(s string, x float64, y float64, ax float64, ay float64)
+
+	Push()
+	Pop()
+	Identity()
+	Scale(x float64, y float64)
+	Translate(x float64, y float64)
+	TransformPoint(x float64, y float64) (float64, float64)
+	Height() int
+}
+
+// Canvases that keep the meaning of the shapes, such as SVG, can tag the shapes drawn after this with a class.
+// An empty class removes the tag.
+func setClass(dc canvas, class string) {
+	if classCanvas, ok := dc.(interface {
+		SetClass(class string)
+	}); ok {
+		classCanvas.SetClass(class)
+	}
+}
+
+// Canvases that draw the text themselves, such as SVG, also need the font size in pixels
+func setFont(dc canvas, textFont *truetype.Font, size float64) {
+	dc.SetFontFace(truetype.NewFace(textFont, &truetype.Options{Size: size}))
+	if fontSizeCanvas, ok := dc.(interface {
+		SetFontSize(size float64)
+	}); ok {
+		fontSizeCanvas.SetFontSize(size)
+	}
+}
+
+// Lowercase name with dashes, such as tribe-xin-xi
+func getClassName(prefix string, name string) string {
+	return prefix + "-" + strings.ReplaceAll(strings.ToLower(name), " ", "-")
+}
+
+func getTerrainClass(terrain int) string {
+	terrainInfo, ok := terrainTypeInfoMap[terrain]
+	if !ok {
+		return "terrain terrain-unknown"
+	}
+	return "terrain " + getClassName("terrain", terrainInfo.Name)
+}
+
+// Trees, peaks and other shapes drawn on top of the tile, such as terrain-overlay terrain-overlay-forest
+func getTerrainOverlayClass(terrainInfo terrainTypeInfo) string {
+	return "terrain-overlay " + getClassName("terrain-overlay", terrainInfo.Name)
+}
+
+// Players are tagged with their tribe, so the same tribe can be restyled in every map
+func getTribeClass(saveData *polytopiamapmodel.PolytopiaSaveOutput, playerId int) string {
+	tribe, ok := saveData.OwnerTribeMap[playerId]
+	if !ok {
+		return fmt.Sprintf("player-%v", playerId)
+	}
+	return getClassName("tribe", getTribeName(tribe))
+}
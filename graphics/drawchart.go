@@ -0,0 +1,412 @@
+package graphics
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fogleman/gg"
+	polytopiamapmodel "github.com/samuelyuan/polytopiamapmodelgo"
+)
+
+const (
+	defaultChartWidth  = 800
+	defaultChartHeight = 400
+
+	chartFontSize     = 12.0
+	chartMarginLeft   = 48.0
+	chartMarginTop    = 16.0
+	chartMarginBottom = 32.0
+	chartLegendWidth  = 180.0
+	chartLegendRow    = 18.0
+	chartSwatchSize   = 10.0
+	// Number of gridlines above the bottom of the chart
+	chartShareTicks = 4
+	chartTurnTicks  = 10
+	// Lines of the replay chart end in a dot at the turn being shown
+	chartLineWidth = 2.0
+	chartDotRadius = 3.0
+	// The chart beside a replay is this many times as wide as it is tall
+	replayChartAspect = 2.0
+)
+
+var (
+	chartBackgroundColor = color.RGBA{32, 32, 32, 255}
+	chartGridColor       = color.RGBA{80, 80, 80, 255}
+	chartTextColor       = color.RGBA{220, 220, 220, 255}
+	chartCursorColor     = color.RGBA{255, 255, 255, 255}
+)
+
+type chartPlayer struct {
+	playerId int
+	name     string
+	color    color.RGBA
+	class    string
+}
+
+// Stacked area of one player, going along the top edge and back along the bottom edge
+type chartArea struct {
+	player chartPlayer
+	points [][2]float64
+}
+
+// Share of the map of one player at the end of every turn
+type chartLine struct {
+	player chartPlayer
+	points [][2]float64
+}
+
+// Positions of the territory chart, in pixels before scaling
+type chartLayout struct {
+	width      float64
+	height     float64
+	plotX      float64
+	plotY      float64
+	plotWidth  float64
+	plotHeight float64
+	maxTurn    int
+	totalTiles int
+	// Share of the map at the top of the chart, rounded up to the next 10%
+	maxShare float64
+	players  []chartPlayer
+	// Players are drawn as stacked areas, or as separate lines if false
+	stacked bool
+}
+
+func newChartLayout(saveData *polytopiamapmodel.PolytopiaSaveOutput, territoryStats []TerritoryStats, width float64, height float64, stacked bool) chartLayout {
+	chart := chartLayout{
+		width:      width,
+		height:     height,
+		plotX:      chartMarginLeft,
+		plotY:      chartMarginTop,
+		plotWidth:  math.Max(1, width-chartMarginLeft-chartLegendWidth),
+		plotHeight: math.Max(1, height-chartMarginTop-chartMarginBottom),
+		maxTurn:    max(1, saveData.MaxTurn),
+		totalTiles: max(1, saveData.MapWidth*saveData.MapHeight),
+		players:    make([]chartPlayer, 0),
+		stacked:    stacked,
+	}
+
+	for i := 0; i < len(saveData.PlayerData); i++ {
+		playerData := saveData.PlayerData[i]
+		if playerData.PlayerId == 0 || playerData.PlayerId == 255 {
+			continue
+		}
+		chart.players = append(chart.players, chartPlayer{
+			playerId: playerData.PlayerId,
+			name:     getPlayerName(saveData, playerData.PlayerId),
+			color:    getPlayerColor(saveData, playerData.PlayerId),
+			class:    getTribeClass(saveData, playerData.PlayerId),
+		})
+	}
+
+	// Stacked areas reach the tiles of every player together, lines only reach the tiles of the largest player
+	maxOwnedTiles := 0
+	for _, stats := range territoryStats {
+		ownedTiles := 0
+		for _, player := range chart.players {
+			if stacked {
+				ownedTiles += stats.Tiles[player.playerId]
+			} else {
+				ownedTiles = max(ownedTiles, stats.Tiles[player.playerId])
+			}
+		}
+		maxOwnedTiles = max(maxOwnedTiles, ownedTiles)
+	}
+	chart.maxShare = math.Min(1, math.Max(0.1, math.Ceil(float64(maxOwnedTiles)/float64(chart.totalTiles)*10)/10))
+	return chart
+}
+
+func (chart chartLayout) getPoint(turn int, tiles int) [2]float64 {
+	x := chart.plotX
+	if chart.maxTurn > 1 {
+		x += float64(turn-1) / float64(chart.maxTurn-1) * chart.plotWidth
+	}
+	share := float64(tiles) / float64(chart.totalTiles) / chart.maxShare
+	y := chart.plotY + chart.plotHeight*(1-share)
+	return [2]float64{x, y}
+}
+
+// Each player's area is stacked on top of the players before them
+func (chart chartLayout) buildAreas(territoryStats []TerritoryStats) []chartArea {
+	areas := make([]chartArea, 0, len(chart.players))
+	for playerIndex, player := range chart.players {
+		top := make([][2]float64, 0, len(territoryStats))
+		bottom := make([][2]float64, 0, len(territoryStats))
+		for _, stats := range territoryStats {
+			tilesBelow := 0
+			for _, playerBelow := range chart.players[:playerIndex] {
+				tilesBelow += stats.Tiles[playerBelow.playerId]
+			}
+			top = append(top, chart.getPoint(stats.Turn, tilesBelow+stats.Tiles[player.playerId]))
+			bottom = append(bottom, chart.getPoint(stats.Turn, tilesBelow))
+		}
+
+		points := top
+		for i := len(bottom) - 1; i >= 0; i-- {
+			points = append(points, bottom[i])
+		}
+		areas = append(areas, chartArea{player: player, points: points})
+	}
+	return areas
+}
+
+func (chart chartLayout) buildLines(territoryStats []TerritoryStats) []chartLine {
+	lines := make([]chartLine, 0, len(chart.players))
+	for _, player := range chart.players {
+		points := make([][2]float64, 0, len(territoryStats))
+		for _, stats := range territoryStats {
+			points = append(points, chart.getPoint(stats.Turn, stats.Tiles[player.playerId]))
+		}
+		lines = append(lines, chartLine{player: player, points: points})
+	}
+	return lines
+}
+
+// Turns labeled along the bottom of the chart
+func (chart chartLayout) getTurnTicks() []int {
+	step := max(1, int(math.Ceil(float64(chart.maxTurn)/chartTurnTicks)))
+	ticks := make([]int, 0)
+	for turn := 1; turn <= chart.maxTurn; turn += step {
+		ticks = append(ticks, turn)
+	}
+	return ticks
+}
+
+func (chart chartLayout) getShareTickY(tick int) float64 {
+	return chart.plotY + chart.plotHeight*(1-float64(tick)/chartShareTicks)
+}
+
+func (chart chartLayout) getShareTickLabel(tick int) string {
+	return fmt.Sprintf("%.0f%%", chart.maxShare*100*float64(tick)/chartShareTicks)
+}
+
+func (chart chartLayout) getLegendText(player chartPlayer, territoryStats []TerritoryStats) string {
+	if len(territoryStats) == 0 {
+		return player.name
+	}
+	stats := territoryStats[len(territoryStats)-1]
+	return fmt.Sprintf("%v: %v, %v", player.name,
+		getCountText(stats.Tiles[player.playerId], "tile", "tiles"), getCountText(stats.Cities[player.playerId], "city", "cities"))
+}
+
+func getCountText(count int, singular string, plural string) string {
+	if count == 1 {
+		return fmt.Sprintf("%v %v", count, singular)
+	}
+	return fmt.Sprintf("%v %v", count, plural)
+}
+
+func (chart chartLayout) getLegendPosition(playerIndex int) (float64, float64) {
+	return chart.width - chartLegendWidth + 12, chart.plotY + float64(playerIndex)*chartLegendRow
+}
+
+func setChartColor(dc canvas, c color.RGBA) {
+	dc.SetRGB255(int(c.R), int(c.G), int(c.B))
+}
+
+func drawChartAreas(dc canvas, areas []chartArea) {
+	for _, area := range areas {
+		if len(area.points) == 0 {
+			continue
+		}
+		dc.MoveTo(area.points[0][0], area.points[0][1])
+		for _, point := range area.points[1:] {
+			dc.LineTo(point[0], point[1])
+		}
+		dc.ClosePath()
+		setClass(dc, "area "+area.player.class)
+		setChartColor(dc, area.player.color)
+		dc.FillPreserve()
+		dc.Stroke()
+	}
+}
+
+// A line with a single turn is only a dot
+func drawChartLines(dc canvas, lines []chartLine) {
+	setLineWidth(dc, chartLineWidth)
+	for _, line := range lines {
+		if len(line.points) == 0 {
+			continue
+		}
+		setClass(dc, "line "+line.player.class)
+		setChartColor(dc, line.player.color)
+		dc.MoveTo(line.points[0][0], line.points[0][1])
+		for _, point := range line.points[1:] {
+			dc.LineTo(point[0], point[1])
+		}
+		dc.Stroke()
+		lastPoint := line.points[len(line.points)-1]
+		dc.DrawCircle(lastPoint[0], lastPoint[1], chartDotRadius)
+		dc.Fill()
+	}
+	setLineWidth(dc, 1.0)
+}
+
+// A cursor is drawn at the cursor turn unless it is zero
+func drawTerritoryChart(dc canvas, chart chartLayout, territoryStats []TerritoryStats, cursorTurn int) {
+	setClass(dc, "background")
+	dc.DrawRectangle(0, 0, chart.width, chart.height)
+	setChartColor(dc, chartBackgroundColor)
+	dc.Fill()
+
+	setLineWidth(dc, 1.0)
+	for tick := 0; tick <= chartShareTicks; tick++ {
+		y := chart.getShareTickY(tick)
+		setClass(dc, "grid")
+		setChartColor(dc, chartGridColor)
+		dc.DrawLine(chart.plotX, y, chart.plotX+chart.plotWidth, y)
+		dc.Stroke()
+		setClass(dc, "label")
+		setChartColor(dc, chartTextColor)
+		drawStringAnchored(dc, chart.getShareTickLabel(tick), chart.plotX-6, y, 1, 0.35)
+	}
+	for _, turn := range chart.getTurnTicks() {
+		point := chart.getPoint(turn, 0)
+		drawStringAnchored(dc, fmt.Sprintf("%v", turn), point[0], point[1]+6, 0.5, 1)
+	}
+	drawStringAnchored(dc, "Turn", chart.plotX+chart.plotWidth/2, chart.height-4, 0.5, 0)
+
+	// The cursor is behind the lines so that it doesn't hide where they end
+	if cursorTurn > 0 {
+		cursor := chart.getPoint(cursorTurn, 0)
+		setClass(dc, "cursor")
+		setChartColor(dc, chartCursorColor)
+		setLineWidth(dc, 2.0)
+		dc.DrawLine(cursor[0], chart.plotY, cursor[0], chart.plotY+chart.plotHeight)
+		dc.Stroke()
+		setLineWidth(dc, 1.0)
+	}
+
+	if chart.stacked {
+		drawChartAreas(dc, chart.buildAreas(territoryStats))
+	} else {
+		drawChartLines(dc, chart.buildLines(territoryStats))
+	}
+
+	for playerIndex, player := range chart.players {
+		x, y := chart.getLegendPosition(playerIndex)
+		setClass(dc, "legend-swatch "+player.class)
+		dc.DrawRectangle(x, y, chartSwatchSize, chartSwatchSize)
+		setChartColor(dc, player.color)
+		dc.Fill()
+		setClass(dc, "legend")
+		setChartColor(dc, chartTextColor)
+		drawStringAnchored(dc, chart.getLegendText(player, territoryStats), x+chartSwatchSize+6, y+chartSwatchSize/2, 0, 0.35)
+	}
+	setClass(dc, "")
+}
+
+func getChartSize(options RenderOptions) (float64, float64) {
+	width := float64(defaultChartWidth)
+	if options.Width > 0 {
+		width = float64(options.Width)
+	}
+	height := float64(defaultChartHeight)
+	if options.Height > 0 {
+		height = float64(options.Height)
+	}
+	return width, height
+}
+
+// Draw the chart on the canvas returned by newCanvas, which is given the image size in pixels
+func drawTerritoryChartOnCanvas(saveData *polytopiamapmodel.PolytopiaSaveOutput, territoryStats []TerritoryStats, options RenderOptions, newCanvas func(width int, height int) canvas) error {
+	font, err := getFont()
+	if err != nil {
+		return err
+	}
+
+	width, height := getChartSize(options)
+	scale := 1.0
+	if options.Scale > 0 {
+		scale = options.Scale
+	}
+	dc := newCanvas(int(math.Ceil(width*scale)), int(math.Ceil(height*scale)))
+	dc.Scale(scale, scale)
+	setFont(dc, font, chartFontSize*scale)
+
+	drawTerritoryChart(dc, newChartLayout(saveData, territoryStats, width, height, true), territoryStats, 0)
+	return nil
+}
+
+// Draw a stacked area chart of each player's share of the map over time.
+// The width and height from the options set the chart size, and the scale multiplies it.
+func DrawTerritoryChart(saveData *polytopiamapmodel.PolytopiaSaveOutput, territoryStats []TerritoryStats, options RenderOptions) (image.Image, error) {
+	var dc *gg.Context
+	err := drawTerritoryChartOnCanvas(saveData, territoryStats, options, func(width int, height int) canvas {
+		dc = gg.NewContext(width, height)
+		return dc
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dc.Image(), nil
+}
+
+// Encode the territory chart as an SVG, which stays sharp at any size
+func EncodeTerritoryChartSVG(w io.Writer, saveData *polytopiamapmodel.PolytopiaSaveOutput, territoryStats []TerritoryStats, options RenderOptions) error {
+	var dc *svgCanvas
+	err := drawTerritoryChartOnCanvas(saveData, territoryStats, options, func(width int, height int) canvas {
+		dc = newSVGCanvas(width, height)
+		return dc
+	})
+	if err != nil {
+		return err
+	}
+	return dc.Encode(w)
+}
+
+// Replay frame with a line for each player's territory up to the game state drawn to the right of the map.
+// The chart is as tall as the map and its axes are set by the stats of the whole game.
+// Score isn't plotted because the save only has each player's current score, not the score of past turns.
+func drawMapWithChart(mapImage image.Image, gameState *GameState, territoryStats []TerritoryStats, options RenderOptions) (image.Image, error) {
+	font, err := getFont()
+	if err != nil {
+		return nil, err
+	}
+
+	scale := 1.0
+	if options.Scale > 0 {
+		scale = options.Scale
+	}
+	mapBounds := mapImage.Bounds()
+	chartHeight := float64(mapBounds.Dy()) / scale
+	chartWidth := chartHeight * replayChartAspect
+
+	dc := gg.NewContext(mapBounds.Dx()+int(math.Ceil(chartWidth*scale)), mapBounds.Dy())
+	dc.DrawImage(mapImage, -mapBounds.Min.X, -mapBounds.Min.Y)
+	dc.Translate(float64(mapBounds.Dx()), 0)
+	dc.Scale(scale, scale)
+	setFont(dc, font, chartFontSize*scale)
+
+	chart := newChartLayout(gameState.saveData, territoryStats, chartWidth, chartHeight, false)
+	drawTerritoryChart(dc, chart, getTerritoryStatsUntil(territoryStats, gameState), gameState.Turn)
+	return dc.Image(), nil
+}
+
+// Save the territory chart as an SVG if the filename ends in .svg, otherwise as a PNG
+func SaveTerritoryChart(outputFilename string, saveData *polytopiamapmodel.PolytopiaSaveOutput, territoryStats []TerritoryStats, options RenderOptions) error {
+	if strings.ToLower(filepath.Ext(outputFilename)) != ".svg" {
+		chartImage, err := DrawTerritoryChart(saveData, territoryStats, options)
+		if err != nil {
+			return err
+		}
+		return SaveImage(outputFilename, chartImage)
+	}
+
+	outputFile, err := os.Create(outputFilename)
+	if err != nil {
+		return fmt.Errorf("failed to save chart to %v: %w", outputFilename, err)
+	}
+	defer outputFile.Close()
+
+	if err := EncodeTerritoryChartSVG(outputFile, saveData, territoryStats, options); err != nil {
+		return fmt.Errorf("failed to encode chart to %v: %w", outputFilename, err)
+	}
+	return outputFile.Close()
+}
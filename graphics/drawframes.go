@@ -0,0 +1,97 @@
+package graphics
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+
+	"github.com/samuelyuan/PolytopiaMapImage/actions"
+	polytopiamapmodel "github.com/samuelyuan/polytopiamapmodelgo"
+)
+
+const (
+	manifestFilename = "manifest.json"
+)
+
+type ReplayManifestFrame struct {
+	Filename   string        `json:"filename"`
+	Turn       int           `json:"turn"`
+	PlayerId   int           `json:"playerId,omitempty"`
+	PlayerName string        `json:"playerName,omitempty"`
+	Events     []ReplayEvent `json:"events"`
+}
+
+type ReplayManifest struct {
+	MapName string                `json:"mapName"`
+	MaxTurn int                   `json:"maxTurn"`
+	Frames  []ReplayManifestFrame `json:"frames"`
+}
+
+// Frames are named by turn, with a second number when a turn has more than one frame
+func getFrameFilename(frame replayFrame, frameInTurn int, granularity ReplayGranularity) string {
+	if granularity == "" || granularity == ReplayGranularityRound {
+		return fmt.Sprintf("turn_%04d.png", frame.Turn)
+	}
+	return fmt.Sprintf("turn_%04d_%03d.png", frame.Turn, frameInTurn)
+}
+
+// Save every replay frame as a numbered PNG in the output directory,
+// along with a manifest listing the turn and events of each frame.
+func SaveReplayFrames(saveData *polytopiamapmodel.PolytopiaSaveOutput, replayActions []actions.Action, outputDirectory string, options ReplayOptions) error {
+	state, frames, err := newReplay(saveData, replayActions, options)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(outputDirectory, 0755); err != nil {
+		return fmt.Errorf("failed to create %v: %w", outputDirectory, err)
+	}
+
+	manifest := ReplayManifest{
+		MapName: saveData.MapHeaderOutput.MapName,
+		MaxTurn: saveData.MaxTurn,
+		Frames:  make([]ReplayManifestFrame, 0, len(frames)),
+	}
+
+	frameInTurn := 0
+	drawFrame := newFrameDrawer(options, state.getLayoutTerritoryStats(options))
+	err = state.drawFrames(frames, drawFrame, func(frameIndex int, mapImage image.Image, gameState *GameState) error {
+		frame := frames[frameIndex]
+		if frameIndex > 0 && frames[frameIndex-1].Turn == frame.Turn {
+			frameInTurn++
+		} else {
+			frameInTurn = 1
+		}
+
+		filename := getFrameFilename(frame, frameInTurn, options.Granularity)
+		if err := SaveImage(filepath.Join(outputDirectory, filename), mapImage); err != nil {
+			return err
+		}
+
+		manifestFrame := ReplayManifestFrame{
+			Filename: filename,
+			Turn:     frame.Turn,
+			PlayerId: frame.PlayerId,
+			Events:   gameState.Events,
+		}
+		if frame.PlayerId != 0 {
+			manifestFrame.PlayerName = getPlayerName(saveData, frame.PlayerId)
+		}
+		manifest.Frames = append(manifest.Frames, manifestFrame)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	manifestPath := filepath.Join(outputDirectory, manifestFilename)
+	if err := os.WriteFile(manifestPath, manifestData, 0644); err != nil {
+		return fmt.Errorf("failed to save manifest to %v: %w", manifestPath, err)
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package graphics
+
+import (
+	"image/color"
+	"math"
+
+	polytopiamapmodel "github.com/samuelyuan/polytopiamapmodelgo"
+)
+
+const (
+	improvementCity = 1
+	improvementRuin = 2
+	improvementPort = 12
+
+	// Build actions with these types add to the tile's road network instead of placing an improvement
+	improvementRoad       = 15
+	improvementBridge     = 16
+	improvementWaterRoute = 17
+)
+
+type improvementCategory int
+
+const (
+	improvementCategoryOther improvementCategory = iota
+	improvementCategoryFarm
+	improvementCategoryMine
+	improvementCategoryPort
+	improvementCategoryTemple
+	improvementCategoryMonument
+	improvementCategoryWorkshop
+	improvementCategoryWindmill
+	improvementCategoryMarket
+	improvementCategoryRuin
+	improvementCategoryTribeUnique
+)
+
+type improvementTypeInfo struct {
+	Name     string
+	Category improvementCategory
+	Color    color.RGBA
+}
+
+var (
+	improvementTypeInfoMap = map[int]improvementTypeInfo{
+		improvementRuin: {Name: "Ruin", Category: improvementCategoryRuin, Color: color.RGBA{150, 140, 120, 255}},
+		5:               {Name: "Farm", Category: improvementCategoryFarm, Color: color.RGBA{230, 190, 70, 255}},
+		6:               {Name: "Windmill", Category: improvementCategoryWindmill, Color: color.RGBA{245, 235, 210, 255}},
+		8:               {Name: "Lumber Hut", Category: improvementCategoryWorkshop, Color: color.RGBA{150, 100, 50, 255}},
+		9:               {Name: "Sawmill", Category: improvementCategoryWorkshop, Color: color.RGBA{196, 140, 80, 255}},
+		10:              {Name: "Mine", Category: improvementCategoryMine, Color: color.RGBA{90, 90, 95, 255}},
+		11:              {Name: "Forge", Category: improvementCategoryWorkshop, Color: color.RGBA{220, 80, 30, 255}},
+		improvementPort: {Name: "Port", Category: improvementCategoryPort, Color: color.RGBA{120, 80, 40, 255}},
+		13:              {Name: "Market", Category: improvementCategoryMarket, Color: color.RGBA{255, 200, 0, 255}},
+		20:              {Name: "Temple", Category: improvementCategoryTemple, Color: color.RGBA{250, 250, 240, 255}},
+		21:              {Name: "Forest Temple", Category: improvementCategoryTemple, Color: color.RGBA{170, 220, 150, 255}},
+		22:              {Name: "Water Temple", Category: improvementCategoryTemple, Color: color.RGBA{150, 200, 240, 255}},
+		23:              {Name: "Mountain Temple", Category: improvementCategoryTemple, Color: color.RGBA{200, 200, 210, 255}},
+		24:              {Name: "Ice Temple", Category: improvementCategoryTemple, Color: color.RGBA{220, 245, 255, 255}},
+		30:              {Name: "Altar of Peace", Category: improvementCategoryMonument, Color: color.RGBA{255, 255, 255, 255}},
+		31:              {Name: "Tower of Wisdom", Category: improvementCategoryMonument, Color: color.RGBA{120, 170, 255, 255}},
+		32:              {Name: "Grand Bazaar", Category: improvementCategoryMonument, Color: color.RGBA{255, 200, 0, 255}},
+		33:              {Name: "Emperor's Tomb", Category: improvementCategoryMonument, Color: color.RGBA{200, 160, 60, 255}},
+		34:              {Name: "Gate of Power", Category: improvementCategoryMonument, Color: color.RGBA{230, 60, 60, 255}},
+		35:              {Name: "Park of Fortune", Category: improvementCategoryMonument, Color: color.RGBA{80, 200, 80, 255}},
+		36:              {Name: "Eye of God", Category: improvementCategoryMonument, Color: color.RGBA{180, 100, 230, 255}},
+		40:              {Name: "Ice Bank", Category: improvementCategoryTribeUnique, Color: color.RGBA{180, 230, 255, 255}},
+		41:              {Name: "Outpost", Category: improvementCategoryTribeUnique, Color: color.RGBA{130, 180, 220, 255}},
+		42:              {Name: "Atoll", Category: improvementCategoryTribeUnique, Color: color.RGBA{240, 150, 150, 255}},
+		43:              {Name: "Mycelium", Category: improvementCategoryTribeUnique, Color: color.RGBA{170, 110, 210, 255}},
+	}
+)
+
+func getImprovementTypeInfo(improvementType int) improvementTypeInfo {
+	improvementInfo, ok := improvementTypeInfoMap[improvementType]
+	if !ok {
+		// default
+		return improvementTypeInfo{Name: "Unknown", Category: improvementCategoryOther, Color: color.RGBA{200, 200, 200, 255}}
+	}
+	return improvementInfo
+}
+
+func drawFarm(dc canvas, centerX float64, centerY float64, iconColor color.RGBA) {
+	dc.DrawRectangle(centerX-radius*0.3, centerY-radius*0.2, radius*0.6, radius*0.4)
+	dc.SetRGB255(int(iconColor.R), int(iconColor.G), int(iconColor.B))
+	dc.Fill()
+
+	// field rows
+	for k := -1; k <= 1; k++ {
+		rowY := centerY + float64(k)*radius*0.12
+		dc.DrawLine(centerX-radius*0.28, rowY, centerX+radius*0.28, rowY)
+	}
+	dc.SetRGB255(150, 110, 40)
+	dc.Stroke()
+}
+
+func drawMine(dc canvas, centerX float64, centerY float64, iconColor color.RGBA) {
+	// tunnel entrance
+	dc.MoveTo(centerX-radius*0.3, centerY+radius*0.2)
+	dc.LineTo(centerX+radius*0.3, centerY+radius*0.2)
+	dc.LineTo(centerX, centerY-radius*0.25)
+	dc.ClosePath()
+	dc.SetRGB255(int(iconColor.R), int(iconColor.G), int(iconColor.B))
+	dc.Fill()
+
+	dc.DrawRectangle(centerX-radius*0.08, centerY+radius*0.02, radius*0.16, radius*0.18)
+	dc.SetRGB255(20, 20, 20)
+	dc.Fill()
+}
+
+func drawPort(dc canvas, centerX float64, centerY float64, iconColor color.RGBA) {
+	// pier planks
+	dc.DrawRectangle(centerX-radius*0.3, centerY-radius*0.08, radius*0.6, radius*0.16)
+	dc.DrawRectangle(centerX-radius*0.25, centerY-radius*0.25, radius*0.08, radius*0.5)
+	dc.DrawRectangle(centerX+radius*0.17, centerY-radius*0.25, radius*0.08, radius*0.5)
+	dc.SetRGB255(int(iconColor.R), int(iconColor.G), int(iconColor.B))
+	dc.Fill()
+}
+
+func drawHouse(dc canvas, centerX float64, centerY float64, iconColor color.RGBA) {
+	dc.MoveTo(centerX-radius*0.22, centerY+radius*0.22)
+	dc.LineTo(centerX+radius*0.22, centerY+radius*0.22)
+	dc.LineTo(centerX+radius*0.22, centerY-radius*0.05)
+	dc.LineTo(centerX, centerY-radius*0.27)
+	dc.LineTo(centerX-radius*0.22, centerY-radius*0.05)
+	dc.ClosePath()
+	dc.SetRGB255(int(iconColor.R), int(iconColor.G), int(iconColor.B))
+	dc.FillPreserve()
+	dc.SetRGB255(60, 60, 60)
+	dc.Stroke()
+}
+
+// The pips are drawn below the house, but no lower than the bottom of the inner box
+func drawTemple(dc canvas, centerX float64, centerY float64, iconColor color.RGBA, level int, boxBottom float64) {
+	drawHouse(dc, centerX, centerY-radius*0.08, iconColor)
+
+	// one pip per temple level
+	pipY := math.Min(centerY+radius*0.32, boxBottom-radius*0.06)
+	for k := 0; k < level; k++ {
+		pipX := centerX - float64(level-1)*radius*0.06 + float64(k)*radius*0.12
+		dc.DrawCircle(pipX, pipY, radius*0.05)
+	}
+	dc.SetRGB255(255, 215, 0) // gold
+	dc.Fill()
+}
+
+func drawMonument(dc canvas, centerX float64, centerY float64, iconColor color.RGBA) {
+	// obelisk
+	dc.MoveTo(centerX-radius*0.12, centerY+radius*0.3)
+	dc.LineTo(centerX+radius*0.12, centerY+radius*0.3)
+	dc.LineTo(centerX+radius*0.07, centerY-radius*0.2)
+	dc.LineTo(centerX, centerY-radius*0.32)
+	dc.LineTo(centerX-radius*0.07, centerY-radius*0.2)
+	dc.ClosePath()
+	dc.SetRGB255(int(iconColor.R), int(iconColor.G), int(iconColor.B))
+	dc.FillPreserve()
+	dc.SetRGB255(40, 40, 40)
+	dc.Stroke()
+}
+
+func drawWindmill(dc canvas, centerX float64, centerY float64, iconColor color.RGBA) {
+	dc.DrawLine(centerX-radius*0.25, centerY-radius*0.25, centerX+radius*0.25, centerY+radius*0.25)
+	dc.DrawLine(centerX-radius*0.25, centerY+radius*0.25, centerX+radius*0.25, centerY-radius*0.25)
+	dc.SetRGB255(int(iconColor.R), int(iconColor.G), int(iconColor.B))
+	setLineWidth(dc, 3.0)
+	dc.Stroke()
+	setLineWidth(dc, 1.0)
+
+	dc.DrawCircle(centerX, centerY, radius*0.06)
+	dc.SetRGB255(100, 70, 40)
+	dc.Fill()
+}
+
+func drawMarket(dc canvas, centerX float64, centerY float64, iconColor color.RGBA) {
+	dc.DrawCircle(centerX, centerY, radius*0.2)
+	dc.SetRGB255(int(iconColor.R), int(iconColor.G), int(iconColor.B))
+	dc.FillPreserve()
+	dc.SetRGB255(150, 110, 0)
+	dc.Stroke()
+}
+
+func drawRuin(dc canvas, centerX float64, centerY float64, iconColor color.RGBA) {
+	// broken columns
+	dc.DrawRectangle(centerX-radius*0.25, centerY-radius*0.15, radius*0.1, radius*0.35)
+	dc.DrawRectangle(centerX-radius*0.05, centerY, radius*0.1, radius*0.2)
+	dc.DrawRectangle(centerX+radius*0.15, centerY-radius*0.08, radius*0.1, radius*0.28)
+	dc.SetRGB255(int(iconColor.R), int(iconColor.G), int(iconColor.B))
+	dc.Fill()
+}
+
+func drawDiamond(dc canvas, centerX float64, centerY float64, iconColor color.RGBA) {
+	dc.DrawRegularPolygon(4, centerX, centerY, radius*0.22, 0)
+	dc.SetRGB255(int(iconColor.R), int(iconColor.G), int(iconColor.B))
+	dc.FillPreserve()
+	dc.SetRGB255(40, 40, 40)
+	dc.Stroke()
+}
+
+func drawImprovement(dc canvas, layout mapLayout, i int, j int, improvementType int, improvementData *polytopiamapmodel.ImprovementData) {
+	centerX, centerY := layout.getTileCenter(i, j)
+	_, boxY, _, boxHeight := layout.getInnerBox(i, j)
+	improvementInfo := getImprovementTypeInfo(improvementType)
+	iconColor := improvementInfo.Color
+
+	switch improvementInfo.Category {
+	case improvementCategoryFarm:
+		drawFarm(dc, centerX, centerY, iconColor)
+	case improvementCategoryMine:
+		drawMine(dc, centerX, centerY, iconColor)
+	case improvementCategoryPort:
+		drawPort(dc, centerX, centerY, iconColor)
+	case improvementCategoryTemple:
+		level := 1
+		if improvementData != nil && improvementData.Level > 0 {
+			level = improvementData.Level
+		}
+		drawTemple(dc, centerX, centerY, iconColor, level, boxY+boxHeight)
+	case improvementCategoryMonument:
+		drawMonument(dc, centerX, centerY, iconColor)
+	case improvementCategoryWorkshop:
+		drawHouse(dc, centerX, centerY, iconColor)
+	case improvementCategoryWindmill:
+		drawWindmill(dc, centerX, centerY, iconColor)
+	case improvementCategoryMarket:
+		drawMarket(dc, centerX, centerY, iconColor)
+	case improvementCategoryRuin:
+		drawRuin(dc, centerX, centerY, iconColor)
+	case improvementCategoryTribeUnique:
+		drawDiamond(dc, centerX, centerY, iconColor)
+	default:
+		// unknown improvement
+		drawDiamond(dc, centerX, centerY, iconColor)
+	}
+}
+
+func drawImprovements(dc canvas, layout mapLayout, saveData *polytopiamapmodel.PolytopiaSaveOutput) {
+	for _, tileIndex := range layout.drawOrder {
+		i, j := tileIndex[0], tileIndex[1]
+		tileData := saveData.TileData[i][j]
+		// Cities are drawn in their own layer
+		if !tileData.ImprovementExists || tileData.ImprovementType == improvementCity {
+			continue
+		}
+
+		setClass(dc, "improvement")
+		drawImprovement(dc, layout, i, j, tileData.ImprovementType, tileData.ImprovementData)
+	}
+}
@@ -0,0 +1,184 @@
+package graphics
+
+import (
+	"fmt"
+	"image/color"
+	"sort"
+
+	"github.com/golang/freetype/truetype"
+	polytopiamapmodel "github.com/samuelyuan/polytopiamapmodelgo"
+	"golang.org/x/image/font"
+)
+
+const (
+	legendFontSize    = 14.0
+	legendPadding     = 8.0
+	legendRowHeight   = 22.0
+	legendSwatchSize  = 12.0
+	legendColumnSpace = 12.0
+)
+
+var (
+	tribeNames = map[int]string{
+		1:  "Nature",
+		2:  "Ai-Mo",
+		3:  "Aquarion",
+		4:  "Bardur",
+		5:  "Elyrion",
+		6:  "Hoodrick",
+		7:  "Imperius",
+		8:  "Kickoo",
+		9:  "Luxidoor",
+		10: "Oumaji",
+		11: "Quetzali",
+		12: "Vengir",
+		13: "Xin-xi",
+		14: "Yadakk",
+		15: "Zebasi",
+		16: "Polaris",
+		17: "Cymanti",
+	}
+
+	legendHeaders = []string{"Player", "Tribe", "Score", "Cities", "Kills/Losses"}
+	// Same headers without the score
+	legendHeadersWithoutScore = []string{"Player", "Tribe", "Cities", "Kills/Losses"}
+)
+
+func getTribeName(tribe int) string {
+	tribeName, ok := tribeNames[tribe]
+	if !ok {
+		return fmt.Sprintf("Tribe %v", tribe)
+	}
+	return tribeName
+}
+
+type legendRow struct {
+	color color.RGBA
+	class string
+	score int
+	// Text in the same order as the headers
+	cells []string
+}
+
+// Scoreboard drawn beside the map, sized in the same units as the map before it is scaled
+type legendLayout struct {
+	headers []string
+	rows    []legendRow
+	columnX []float64
+	width   float64
+	height  float64
+}
+
+// Cities are counted from the tiles so that the legend matches the map being drawn, such as a replay frame
+func countCities(saveData *polytopiamapmodel.PolytopiaSaveOutput) map[int]int {
+	cityCount := make(map[int]int)
+	for i := 0; i < saveData.MapHeight; i++ {
+		for j := 0; j < saveData.MapWidth; j++ {
+			tileData := saveData.TileData[i][j]
+			if tileData.ImprovementType == improvementCity && tileData.ImprovementData != nil && tileData.Owner > 0 {
+				cityCount[tileData.Owner]++
+			}
+		}
+	}
+	return cityCount
+}
+
+// One row for every player except nature, sorted by score.
+// Without the score, the rows are left in player order so that they don't move between replay frames.
+func buildLegendRows(saveData *polytopiamapmodel.PolytopiaSaveOutput, hideScore bool) []legendRow {
+	cityCount := countCities(saveData)
+	rows := make([]legendRow, 0)
+	for i := 0; i < len(saveData.PlayerData); i++ {
+		playerData := saveData.PlayerData[i]
+		if playerData.PlayerId == 0 || playerData.PlayerId == 255 {
+			continue
+		}
+		cells := []string{
+			getPlayerName(saveData, playerData.PlayerId),
+			getTribeName(playerData.Tribe),
+			fmt.Sprintf("%v", playerData.Score),
+			fmt.Sprintf("%v", cityCount[playerData.PlayerId]),
+			fmt.Sprintf("%v/%v", playerData.TotalUnitsKilled, playerData.TotalUnitsLost),
+		}
+		if hideScore {
+			cells = append(cells[:2], cells[3:]...)
+		}
+		rows = append(rows, legendRow{
+			color: getPlayerColor(saveData, playerData.PlayerId),
+			class: getTribeClass(saveData, playerData.PlayerId),
+			score: playerData.Score,
+			cells: cells,
+		})
+	}
+	if hideScore {
+		return rows
+	}
+	sort.SliceStable(rows, func(a int, b int) bool {
+		return rows[a].score > rows[b].score
+	})
+	return rows
+}
+
+// Columns are as wide as their longest text
+func newLegendLayout(saveData *polytopiamapmodel.PolytopiaSaveOutput, legendFont *truetype.Font, hideScore bool) legendLayout {
+	face := truetype.NewFace(legendFont, &truetype.Options{Size: legendFontSize})
+	defer face.Close()
+
+	headers := legendHeaders
+	if hideScore {
+		headers = legendHeadersWithoutScore
+	}
+	rows := buildLegendRows(saveData, hideScore)
+	columnWidths := make([]float64, len(headers))
+	for column, header := range headers {
+		columnWidths[column] = float64(font.MeasureString(face, header)) / 64
+		for _, row := range rows {
+			columnWidths[column] = max(columnWidths[column], float64(font.MeasureString(face, row.cells[column]))/64)
+		}
+	}
+
+	columnX := make([]float64, len(headers))
+	x := legendPadding + legendSwatchSize + legendColumnSpace/2
+	for column, columnWidth := range columnWidths {
+		columnX[column] = x
+		x += columnWidth + legendColumnSpace
+	}
+
+	return legendLayout{
+		headers: headers,
+		rows:    rows,
+		columnX: columnX,
+		width:   x - legendColumnSpace + legendPadding,
+		height:  float64(len(rows)+1)*legendRowHeight + 2*legendPadding,
+	}
+}
+
+// Draw the legend with its left edge at x, filling the whole height of the image
+func drawLegend(dc canvas, legend legendLayout, x float64) {
+	setClass(dc, "legend")
+	dc.DrawRectangle(x, 0, legend.width, float64(dc.Height())/getContextScale(dc))
+	dc.SetRGB255(32, 32, 32)
+	dc.Fill()
+
+	drawLegendRow := func(rowIndex int, cells []string) {
+		textY := legendPadding + (float64(rowIndex)+0.5)*legendRowHeight
+		for column, cell := range cells {
+			drawStringAnchored(dc, cell, x+legend.columnX[column], textY, 0, 0.35)
+		}
+	}
+
+	dc.SetRGB255(180, 180, 180)
+	drawLegendRow(0, legend.headers)
+	for i, row := range legend.rows {
+		swatchY := legendPadding + (float64(i+1)+0.5)*legendRowHeight - legendSwatchSize/2
+		setClass(dc, "legend-swatch "+row.class)
+		dc.DrawRectangle(x+legendPadding, swatchY, legendSwatchSize, legendSwatchSize)
+		dc.SetRGB255(int(row.color.R), int(row.color.G), int(row.color.B))
+		dc.FillPreserve()
+		dc.SetRGB255(255, 255, 255)
+		dc.Stroke()
+
+		setClass(dc, "legend")
+		drawLegendRow(i+1, row.cells)
+	}
+}
@@ -4,9 +4,15 @@ import (
 	"fmt"
 	"image"
 	"image/color"
+	"image/png"
+	"io"
 	"log"
 	"math"
-	"unicode/utf8"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 
 	"github.com/fogleman/gg"
 	"github.com/golang/freetype/truetype"
@@ -15,18 +21,54 @@ import (
 )
 
 const (
+	// Tiles are drawn with this size and then scaled to the requested tile size
 	radius = 30.0
 )
 
+type RenderOptions struct {
+	// Only show tiles explored by this player id, or the entire map if zero
+	Viewer     int
+	Projection Projection
+	// Tile size in pixels, defaults to 30
+	TileSize float64
+	// Fit the map inside this width and height in pixels, overrides the tile size if either is set
+	Width  int
+	Height int
+	// Multiplies the final image size, such as 2 for high DPI displays
+	Scale float64
+	// Text drawn in the top left corner, such as whose turn is shown in a replay.
+	// Each line of the caption is drawn below the previous one.
+	Caption string
+	// Draw a scoreboard beside the map with the color, tribe and score of every player
+	Legend bool
+	// Leave the score out of the legend, such as for maps of past turns where only the final score is known
+	HideScore bool
+	// Warnings such as unknown terrain are written here, or dropped if nil
+	Logger *log.Logger
+}
+
+type terrainTypeInfo struct {
+	Name    string
+	Color   color.RGBA
+	Overlay func(dc canvas, layout mapLayout, i int, j int)
+}
+
 var (
 	NeighborOffset = [4][2]int{{0, 1}, {-1, 0}, {0, -1}, {1, 0}}
-)
 
-func getImagePosition(i int, j int) (float64, float64) {
-	x := float64(j) * (radius)
-	y := float64(i) * (radius)
-	return x, y
-}
+	terrainTypeInfoMap = map[int]terrainTypeInfo{
+		terrainCloud: {Name: "Cloud", Color: color.RGBA{215, 220, 228, 255}, Overlay: drawCloud},
+		1:            {Name: "Water", Color: color.RGBA{95, 149, 149, 255}},
+		2:            {Name: "Ocean", Color: color.RGBA{47, 74, 93, 255}},
+		3:            {Name: "Field", Color: color.RGBA{105, 125, 54, 255}},
+		4:            {Name: "Mountain", Color: color.RGBA{105, 125, 54, 255}, Overlay: drawMountain},
+		5:            {Name: "Forest", Color: color.RGBA{105, 125, 54, 255}, Overlay: drawForest},
+		6:            {Name: "Ice", Color: color.RGBA{238, 249, 255, 255}, Overlay: drawIce},
+	}
+
+	// Stands out so that unsupported terrain isn't mistaken for any real tile
+	unknownTerrainColor = color.RGBA{255, 0, 255, 255}
+)
 
 func getNeighbors(x int, y int) [4][2]int {
 	offset := NeighborOffset
@@ -42,24 +84,19 @@ func getNeighbors(x int, y int) [4][2]int {
 }
 
 func getPhysicalMapTileColor(terrain int) color.RGBA {
-	switch terrain {
-	case 1: // Water
-		return color.RGBA{95, 149, 149, 255}
-	case 2: // Ocean
-		return color.RGBA{47, 74, 93, 255}
-	case 3, 4, 5: // flat land
-		return color.RGBA{105, 125, 54, 255}
-	case 6: // ice
-		return color.RGBA{238, 249, 255, 255}
-	}
-
-	// default
-	return color.RGBA{0, 0, 0, 255}
+	terrainInfo, ok := terrainTypeInfoMap[terrain]
+	if !ok {
+		return unknownTerrainColor
+	}
+	return terrainInfo.Color
 }
 
 func getPoliticalMapTileColor(saveData *polytopiamapmodel.PolytopiaSaveOutput, row int, column int) color.RGBA {
-	tileOwner := saveData.TileData[row][column].Owner
-	tribe, ok := saveData.OwnerTribeMap[tileOwner]
+	return getPlayerColor(saveData, saveData.TileData[row][column].Owner)
+}
+
+func getPlayerColor(saveData *polytopiamapmodel.PolytopiaSaveOutput, playerId int) color.RGBA {
+	tribe, ok := saveData.OwnerTribeMap[playerId]
 	if !ok {
 		// default
 		return color.RGBA{0, 0, 0, 255}
@@ -67,7 +104,7 @@ func getPoliticalMapTileColor(saveData *polytopiamapmodel.PolytopiaSaveOutput, r
 
 	for i := 0; i < len(saveData.PlayerData); i++ {
 		playerData := saveData.PlayerData[i]
-		if playerData.PlayerId == tileOwner {
+		if playerData.PlayerId == playerId {
 			// override color
 			if playerData.OverrideColor[3] != 255 {
 				return color.RGBA{uint8(playerData.OverrideColor[2]), uint8(playerData.OverrideColor[1]), uint8(playerData.OverrideColor[0]), 255}
@@ -113,92 +150,155 @@ func getPoliticalMapTileColor(saveData *polytopiamapmodel.PolytopiaSaveOutput, r
 	return color.RGBA{128, 128, 128, 255}
 }
 
-func drawCityIcon(dc *gg.Context, imageX float64, imageY float64, cityColor color.RGBA) {
+func drawCityIcon(dc canvas, imageX float64, imageY float64, cityColor color.RGBA) {
 	iconColor := cityColor
 	dc.DrawRectangle(imageX+(radius/4), imageY+(radius/4), radius/2, radius/2)
 	dc.SetRGB255(int(iconColor.R), int(iconColor.G), int(iconColor.B))
 	dc.Fill()
 }
 
-func drawMountain(dc *gg.Context, imageX float64, imageY float64) {
+// The base of mountains and trees sits inside the tile and the top can rise over the tile behind it
+func getGlyphBaseCenter(layout mapLayout, i int, j int) (float64, float64) {
+	boxX, boxY, boxWidth, boxHeight := layout.getInnerBox(i, j)
+	return boxX + boxWidth/2, boxY + boxHeight - (radius / 3)
+}
+
+func drawMountain(dc canvas, layout mapLayout, i int, j int) {
+	baseX, baseY := getGlyphBaseCenter(layout, i, j)
+
 	// draw base
-	dc.DrawRegularPolygon(3, imageX+(radius/2), imageY+(radius/3), radius/2, math.Pi)
+	dc.DrawRegularPolygon(3, baseX, baseY, radius/2, 0)
 	dc.SetRGB255(89, 90, 86) // gray
 	dc.Fill()
 
 	// draw mountain peak
-	dc.DrawRegularPolygon(3, imageX+(radius/2), imageY+(radius*2/3), radius/4, math.Pi)
+	dc.DrawRegularPolygon(3, baseX, baseY-(radius/3), radius/4, 0)
 	dc.SetRGB255(234, 244, 253) // white
 	dc.Fill()
 }
 
-func drawForest(dc *gg.Context, imageX float64, imageY float64) {
-	dc.DrawRegularPolygon(3, imageX+(radius/2), imageY+(radius/3), radius/2, math.Pi)
+func drawForest(dc canvas, layout mapLayout, i int, j int) {
+	baseX, baseY := getGlyphBaseCenter(layout, i, j)
+
+	dc.DrawRegularPolygon(3, baseX, baseY, radius/2, 0)
 	dc.SetRGB255(53, 72, 44) // dark green
 	dc.Fill()
 }
 
-func drawIce(dc *gg.Context, imageX float64, imageY float64) {
-	dc.MoveTo(imageX, imageY)
-	dc.LineTo(imageX, imageY+radius)
-	dc.LineTo(imageX+radius, imageY+radius)
+func drawIce(dc canvas, layout mapLayout, i int, j int) {
+	corners := layout.getTileCorners(i, j)
+
+	dc.MoveTo(corners[3][0], corners[3][1])
+	dc.LineTo(corners[0][0], corners[0][1])
+	dc.LineTo(corners[1][0], corners[1][1])
 	dc.ClosePath()
 	dc.SetRGB255(147, 191, 236) // light blue
 	dc.Fill()
 
-	dc.MoveTo(imageX, imageY)
-	dc.LineTo(imageX+radius, imageY)
-	dc.LineTo(imageX+radius, imageY+radius)
+	dc.MoveTo(corners[3][0], corners[3][1])
+	dc.LineTo(corners[2][0], corners[2][1])
+	dc.LineTo(corners[1][0], corners[1][1])
 	dc.ClosePath()
 	dc.SetRGB255(69, 140, 222) // dark blue
 	dc.Fill()
 }
 
-func drawTerritoryTiles(dc *gg.Context, saveData *polytopiamapmodel.PolytopiaSaveOutput, mapHeight int, mapWidth int) {
-	for i := 0; i < mapHeight; i++ {
-		for j := 0; j < mapWidth; j++ {
-			x, y := getImagePosition(i, j)
+func drawTilePolygon(dc canvas, layout mapLayout, i int, j int) {
+	corners := layout.getTileCorners(i, j)
+	dc.MoveTo(corners[0][0], corners[0][1])
+	for k := 1; k < len(corners); k++ {
+		dc.LineTo(corners[k][0], corners[k][1])
+	}
+	dc.ClosePath()
+}
 
-			dc.DrawRectangle(x, y, radius, radius)
-			tileData := saveData.TileData[i][j]
-			terrain := tileData.Terrain
+// Returns the number of tiles of each terrain type that isn't in the terrain table.
+// Overlays are drawn after every tile so that the tiles in front don't paint over the parts that stick out.
+func drawTerritoryTiles(dc canvas, layout mapLayout, saveData *polytopiamapmodel.PolytopiaSaveOutput) map[int]int {
+	unknownTerrainCount := make(map[int]int)
 
-			terrainTileColor := getPhysicalMapTileColor(terrain)
-			dc.SetRGB255(int(terrainTileColor.R), int(terrainTileColor.G), int(terrainTileColor.B))
-			dc.Fill()
+	for _, tileIndex := range layout.drawOrder {
+		i, j := tileIndex[0], tileIndex[1]
 
-			if terrain == 4 {
-				drawMountain(dc, x, y)
-			} else if terrain == 6 {
-				drawIce(dc, x, y)
-			}
+		drawTilePolygon(dc, layout, i, j)
+		tileData := saveData.TileData[i][j]
+		terrain := tileData.Terrain
+		setClass(dc, getTerrainClass(terrain))
 
-			// Draw cities
-			if tileData.ImprovementData != nil && tileData.ImprovementType == 1 {
-				if tileData.Owner > 0 {
-					// Capital city
-					cityColor := getPoliticalMapTileColor(saveData, i, j)
-					drawCityIcon(dc, x, y, cityColor)
-				} else {
-					// Village
-					drawCityIcon(dc, x, y, color.RGBA{255, 255, 255, 255})
-				}
-			}
+		// Stroke with the same color to cover the seams between tiles
+		terrainTileColor := getPhysicalMapTileColor(terrain)
+		dc.SetRGB255(int(terrainTileColor.R), int(terrainTileColor.G), int(terrainTileColor.B))
+		dc.FillPreserve()
+		dc.Stroke()
+
+		if _, ok := terrainTypeInfoMap[terrain]; !ok {
+			unknownTerrainCount[terrain]++
+		}
+	}
+
+	for _, tileIndex := range layout.drawOrder {
+		i, j := tileIndex[0], tileIndex[1]
+		if terrainInfo, ok := terrainTypeInfoMap[saveData.TileData[i][j].Terrain]; ok && terrainInfo.Overlay != nil {
+			// Only the tile has the terrain class, so restyling the terrain doesn't also paint over its trees or peaks
+			setClass(dc, getTerrainOverlayClass(terrainInfo))
+			terrainInfo.Overlay(dc, layout, i, j)
+		}
+	}
+
+	return unknownTerrainCount
+}
+
+func logUnknownTerrain(logger *log.Logger, unknownTerrainCount map[int]int) {
+	if logger == nil {
+		return
+	}
+	terrains := make([]int, 0, len(unknownTerrainCount))
+	for terrain := range unknownTerrainCount {
+		terrains = append(terrains, terrain)
+	}
+	sort.Ints(terrains)
+	for _, terrain := range terrains {
+		logger.Printf("Warning: unknown terrain type %v on %v tiles", terrain, unknownTerrainCount[terrain])
+	}
+}
+
+func drawCities(dc canvas, layout mapLayout, saveData *polytopiamapmodel.PolytopiaSaveOutput) {
+	for _, tileIndex := range layout.drawOrder {
+		i, j := tileIndex[0], tileIndex[1]
+		tileData := saveData.TileData[i][j]
+		if tileData.ImprovementData == nil || tileData.ImprovementType != improvementCity {
+			continue
+		}
+
+		x, y := layout.getImagePosition(i, j)
+		if tileData.Owner > 0 {
+			// Capital city
+			setClass(dc, "city "+getTribeClass(saveData, tileData.Owner))
+			cityColor := getPoliticalMapTileColor(saveData, i, j)
+			drawCityIcon(dc, x, y, cityColor)
+		} else {
+			// Village
+			setClass(dc, "village")
+			drawCityIcon(dc, x, y, color.RGBA{255, 255, 255, 255})
 		}
 	}
 }
 
-func drawBorders(dc *gg.Context, saveData *polytopiamapmodel.PolytopiaSaveOutput, mapHeight int, mapWidth int) {
+func drawBorders(dc canvas, layout mapLayout, saveData *polytopiamapmodel.PolytopiaSaveOutput) {
+	mapHeight := layout.mapHeight
+	mapWidth := layout.mapWidth
 	for i := 0; i < mapHeight; i++ {
 		for j := 0; j < mapWidth; j++ {
-			x1, y1 := getImagePosition(i, j)
 			neighbors := getNeighbors(j, i)
 			currentTileOwner := saveData.TileData[i][j].Owner
 			if currentTileOwner == 0 {
 				continue
 			}
 
+			centerX, centerY := layout.getTileCenter(i, j)
+			corners := layout.getTileCorners(i, j)
 			tileColor := getPoliticalMapTileColor(saveData, i, j)
+			setClass(dc, "border "+getTribeClass(saveData, currentTileOwner))
 			lineWidth := 1.5
 			for n := 0; n < len(neighbors); n++ {
 				newX := neighbors[n][0]
@@ -206,19 +306,18 @@ func drawBorders(dc *gg.Context, saveData *polytopiamapmodel.PolytopiaSaveOutput
 				if newX >= 0 && newY >= 0 && newX < mapWidth && newY < mapHeight {
 					otherTileOwner := saveData.TileData[newY][newX].Owner
 					if currentTileOwner != otherTileOwner {
-						angle1 := (math.Pi / 4) + float64(n)*(math.Pi/2)
-						angle2 := (math.Pi / 4) + float64(n+1)*(math.Pi/2)
+						// Move the edge slightly inside the tile so that both sides of a border are visible
+						inset := (radius - 1) / radius
+						corner1 := corners[neighborEdgeCorners[n][0]]
+						corner2 := corners[neighborEdgeCorners[n][1]]
 
-						centerX := x1 + (radius / 2)
-						centerY := y1 + (radius / 2)
-
-						edgeX1 := centerX + ((radius-1)*math.Sqrt2/2)*math.Cos(angle1)
-						edgeY1 := centerY + ((radius-1)*math.Sqrt2/2)*math.Sin(angle1)
-						edgeX2 := centerX + ((radius-1)*math.Sqrt2/2)*math.Cos(angle2)
-						edgeY2 := centerY + ((radius-1)*math.Sqrt2/2)*math.Sin(angle2)
+						edgeX1 := centerX + (corner1[0]-centerX)*inset
+						edgeY1 := centerY + (corner1[1]-centerY)*inset
+						edgeX2 := centerX + (corner2[0]-centerX)*inset
+						edgeY2 := centerY + (corner2[1]-centerY)*inset
 
 						dc.SetRGB255(int(tileColor.R), int(tileColor.G), int(tileColor.B))
-						dc.SetLineWidth(lineWidth)
+						setLineWidth(dc, lineWidth)
 						dc.DrawLine(edgeX1, edgeY1, edgeX2, edgeY2)
 						dc.Stroke()
 					}
@@ -226,65 +325,243 @@ func drawBorders(dc *gg.Context, saveData *polytopiamapmodel.PolytopiaSaveOutput
 			}
 		}
 	}
-	dc.SetLineWidth(1.0)
+	setLineWidth(dc, 1.0)
 }
 
-func drawCityNames(dc *gg.Context, saveData *polytopiamapmodel.PolytopiaSaveOutput, mapHeight int, mapWidth int) {
+func drawCityNames(dc canvas, layout mapLayout, saveData *polytopiamapmodel.PolytopiaSaveOutput) {
+	setClass(dc, "city-name")
 	dc.SetRGB255(255, 255, 255)
-	for i := 0; i < mapHeight; i++ {
-		for j := 0; j < mapWidth; j++ {
-			// Invert depth because the map is inverted
-			x, y := getImagePosition(mapHeight-i, j)
+	for _, tileIndex := range layout.drawOrder {
+		i, j := tileIndex[0], tileIndex[1]
 
-			tile := saveData.TileData[i][j]
-			cityName := ""
-			if tile.ImprovementData != nil && tile.ImprovementType == 1 {
-				cityName = tile.ImprovementData.CityName
-			}
-			if len(cityName) == 0 {
-				continue
-			}
+		tile := saveData.TileData[i][j]
+		cityName := ""
+		if tile.ImprovementData != nil && tile.ImprovementType == 1 {
+			cityName = tile.ImprovementData.CityName
+		}
+		if len(cityName) == 0 {
+			continue
+		}
 
-			if utf8.RuneCountInString(cityName) <= 4 {
-				dc.DrawString(cityName, x, y-radius)
-			} else {
-				dc.DrawString(cityName, x-(2.0*float64(len(cityName))/2.0), y-radius)
-			}
+		// Center the name just above the top corner of the tile
+		corners := layout.getTileCorners(i, j)
+		centerX, _ := layout.getTileCenter(i, j)
+		drawStringAnchored(dc, cityName, centerX, corners[0][1], 0.5, 0)
+	}
+}
+
+func drawCaption(dc canvas, caption string) {
+	padding := 4.0
+	lineSpacing := 2.0
+	scale := getContextScale(dc)
+	lines := strings.Split(caption, "\n")
+
+	boxWidth := 0.0
+	lineHeight := dc.FontHeight() / scale
+	for _, line := range lines {
+		textWidth, _ := dc.MeasureString(line)
+		boxWidth = math.Max(boxWidth, textWidth/scale)
+	}
+	boxHeight := float64(len(lines))*lineHeight + float64(len(lines)-1)*lineSpacing
+	setClass(dc, "caption")
+
+	dc.DrawRectangle(0, 0, boxWidth+2*padding, boxHeight+2*padding)
+	dc.SetRGB255(0, 0, 0)
+	dc.Fill()
+
+	dc.SetRGB255(255, 255, 255)
+	for i, line := range lines {
+		drawStringAnchored(dc, line, padding, padding+float64(i)*(lineHeight+lineSpacing), 0, 1)
+	}
+}
+
+// Pixels per unit of tile size. The base image size is the size of everything drawn before scaling.
+func getRenderScale(baseImageWidth float64, baseImageHeight float64, options RenderOptions) float64 {
+	scale := 1.0
+	if options.TileSize > 0 {
+		scale = options.TileSize / radius
+	}
+
+	if options.Width > 0 || options.Height > 0 {
+		scale = math.Inf(1)
+		if options.Width > 0 {
+			scale = math.Min(scale, float64(options.Width)/baseImageWidth)
+		}
+		if options.Height > 0 {
+			scale = math.Min(scale, float64(options.Height)/baseImageHeight)
 		}
 	}
+
+	if options.Scale > 0 {
+		scale *= options.Scale
+	}
+	return scale
+}
+
+// gg doesn't apply the current transformation to line widths and dashes,
+// so they are scaled here to keep the same proportions at any tile size
+func getContextScale(dc canvas) float64 {
+	x0, _ := dc.TransformPoint(0, 0)
+	x1, _ := dc.TransformPoint(1, 0)
+	return x1 - x0
+}
+
+func setLineWidth(dc canvas, lineWidth float64) {
+	dc.SetLineWidth(lineWidth * getContextScale(dc))
+}
+
+func setDash(dc canvas, dashes ...float64) {
+	scale := getContextScale(dc)
+	scaledDashes := make([]float64, len(dashes))
+	for i := 0; i < len(dashes); i++ {
+		scaledDashes[i] = dashes[i] * scale
+	}
+	dc.SetDash(scaledDashes...)
+}
+
+// Text is drawn without the transformation to avoid resampling the glyphs.
+// The font faces are already created at the scaled size.
+func drawStringAnchored(dc canvas, s string, x float64, y float64, ax float64, ay float64) {
+	imageX, imageY := dc.TransformPoint(x, y)
+	dc.Push()
+	dc.Identity()
+	dc.DrawStringAnchored(s, imageX, imageY, ax, ay)
+	dc.Pop()
+}
+
+var (
+	fontOnce   sync.Once
+	parsedFont *truetype.Font
+	fontErr    error
+)
+
+// The font is parsed once and shared, since replays draw the map many times
+func getFont() (*truetype.Font, error) {
+	fontOnce.Do(func() {
+		parsedFont, fontErr = truetype.Parse(goregular.TTF)
+		if fontErr != nil {
+			fontErr = fmt.Errorf("failed to parse font: %w", fontErr)
+		}
+	})
+	return parsedFont, fontErr
 }
 
-func DrawMap(saveData *polytopiamapmodel.PolytopiaSaveOutput) image.Image {
+// Draw the map on the canvas returned by newCanvas, which is given the image size in pixels
+func drawMapOnCanvas(saveData *polytopiamapmodel.PolytopiaSaveOutput, options RenderOptions, newCanvas func(width int, height int) canvas) error {
+	if options.Viewer != 0 {
+		saveData = applyFogOfWar(saveData, options.Viewer)
+	}
+
 	mapHeight := saveData.MapHeight
 	mapWidth := saveData.MapWidth
+	layout := newMapLayout(options.Projection, mapHeight, mapWidth)
 
-	maxImageWidth, maxImageHeight := getImagePosition(mapHeight, mapWidth)
-	dc := gg.NewContext(int(maxImageWidth), int(maxImageHeight))
-	fmt.Println("Map height: ", mapHeight, ", width: ", mapWidth)
-
-	font, err := truetype.Parse(goregular.TTF)
+	font, err := getFont()
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	mapImageWidth, mapImageHeight := layout.getImageSize()
+	maxImageWidth, maxImageHeight := mapImageWidth, mapImageHeight
+	var legend legendLayout
+	if options.Legend {
+		legend = newLegendLayout(saveData, font, options.HideScore)
+		maxImageWidth += legend.width
+		maxImageHeight = math.Max(maxImageHeight, legend.height)
+	}
+
+	scale := getRenderScale(maxImageWidth, maxImageHeight, options)
+	dc := newCanvas(int(math.Ceil(maxImageWidth*scale)), int(math.Ceil(maxImageHeight*scale)))
+	dc.Scale(scale, scale)
+	setLineWidth(dc, 1.0)
+
+	logUnknownTerrain(options.Logger, drawTerritoryTiles(dc, layout, saveData))
+	drawRoads(dc, layout, saveData)
+	drawWaterRoutes(dc, layout, saveData)
+	drawResources(dc, layout, saveData)
+	drawImprovements(dc, layout, saveData)
+	drawCities(dc, layout, saveData)
+	drawBorders(dc, layout, saveData)
+
+	setFont(dc, font, 10*scale)
+	drawUnits(dc, layout, saveData)
+
+	setFont(dc, font, 14*scale)
+	drawCityNames(dc, layout, saveData)
+
+	if options.Caption != "" {
+		drawCaption(dc, options.Caption)
 	}
 
-	face := truetype.NewFace(font, &truetype.Options{Size: 14})
-	dc.SetFontFace(face)
+	if options.Legend {
+		drawLegend(dc, legend, mapImageWidth)
+	}
+	setClass(dc, "")
+	return nil
+}
+
+func DrawMap(saveData *polytopiamapmodel.PolytopiaSaveOutput, options RenderOptions) (image.Image, error) {
+	var dc *gg.Context
+	err := drawMapOnCanvas(saveData, options, func(width int, height int) canvas {
+		dc = gg.NewContext(width, height)
+		return dc
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dc.Image(), nil
+}
 
-	// Need to invert image because the map format is inverted
-	dc.InvertY()
+// Encode the map as an SVG, where every shape has CSS classes for its terrain or tribe
+// so the map can be restyled, such as .unit.tribe-xin-xi { fill: #ff8c00; }
+func EncodeMapSVG(w io.Writer, saveData *polytopiamapmodel.PolytopiaSaveOutput, options RenderOptions) error {
+	var dc *svgCanvas
+	err := drawMapOnCanvas(saveData, options, func(width int, height int) canvas {
+		dc = newSVGCanvas(width, height)
+		return dc
+	})
+	if err != nil {
+		return err
+	}
+	return dc.Encode(w)
+}
 
-	drawTerritoryTiles(dc, saveData, mapHeight, mapWidth)
-	drawBorders(dc, saveData, mapHeight, mapWidth)
+// Save the map as an SVG if the filename ends in .svg, otherwise as a PNG
+func SaveMap(outputFilename string, saveData *polytopiamapmodel.PolytopiaSaveOutput, options RenderOptions) error {
+	if strings.ToLower(filepath.Ext(outputFilename)) != ".svg" {
+		mapImage, err := DrawMap(saveData, options)
+		if err != nil {
+			return fmt.Errorf("failed to draw map: %w", err)
+		}
+		return SaveImage(outputFilename, mapImage)
+	}
 
-	dc.InvertY()
+	outputFile, err := os.Create(outputFilename)
+	if err != nil {
+		return fmt.Errorf("failed to save map to %v: %w", outputFilename, err)
+	}
+	defer outputFile.Close()
 
-	// Draw city names after inversion
-	drawCityNames(dc, saveData, mapHeight, mapWidth)
+	if err := EncodeMapSVG(outputFile, saveData, options); err != nil {
+		return fmt.Errorf("failed to encode map to %v: %w", outputFilename, err)
+	}
+	return outputFile.Close()
+}
 
-	return dc.Image()
+// Encode the map image as a PNG to any writer, such as an HTTP response or a buffer
+func EncodeImage(w io.Writer, im image.Image) error {
+	return png.Encode(w, im)
 }
 
-func SaveImage(outputFilename string, im image.Image) {
-	gg.SavePNG(outputFilename, im)
-	fmt.Println("Saved image to", outputFilename)
+func SaveImage(outputFilename string, im image.Image) error {
+	outputFile, err := os.Create(outputFilename)
+	if err != nil {
+		return fmt.Errorf("failed to save image to %v: %w", outputFilename, err)
+	}
+	defer outputFile.Close()
+
+	if err := EncodeImage(outputFile, im); err != nil {
+		return fmt.Errorf("failed to encode image to %v: %w", outputFilename, err)
+	}
+	return outputFile.Close()
 }
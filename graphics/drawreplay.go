@@ -4,55 +4,231 @@ import (
 	"fmt"
 	"image"
 	"image/color"
-	"image/gif"
-	"log"
+	"io"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 
-	"github.com/samuelyuan/PolytopiaMapImage/graphics/quantize"
+	"github.com/samuelyuan/PolytopiaMapImage/actions"
 	polytopiamapmodel "github.com/samuelyuan/polytopiamapmodelgo"
 )
 
 const (
 	GIF_DELAY = 100
+	// Frames for single actions are shown for less time so that the replay doesn't drag on
+	ACTION_GIF_DELAY = 20
+
+	// Land units are carried by a boat when they move onto water
+	unitBoat = 13
+
+	// City reward that grows the city's border by one tile
+	cityRewardBorderGrowth = 6
+
+	terrainMountain = 4
+	// Units see the tiles next to them, or two tiles away from a mountain
+	unitSightRadius     = 1
+	mountainSightRadius = 2
+)
+
+var (
+	// Colors the drawers set directly, apart from the terrain, improvement and player colors.
+	// GIF frames only use the colors in their palette, so a color added to a drawer must be added here too.
+	drawMapColors = []color.RGBA{
+		// terrain overlays and clouds
+		{89, 90, 86, 255},
+		{234, 244, 253, 255},
+		{53, 72, 44, 255},
+		{147, 191, 236, 255},
+		{69, 140, 222, 255},
+		{250, 250, 252, 255},
+		// roads and water routes
+		{176, 132, 82, 255},
+		{230, 240, 250, 255},
+		// resources
+		{222, 196, 150, 255},
+		{139, 90, 43, 255},
+		{214, 52, 110, 255},
+		{190, 225, 240, 255},
+		{240, 200, 60, 255},
+		{160, 165, 175, 255},
+		{70, 70, 80, 255},
+		{60, 80, 110, 255},
+		{255, 140, 70, 255},
+		{150, 90, 200, 255},
+		{200, 200, 200, 255},
+		// improvement details
+		{150, 110, 40, 255},
+		{20, 20, 20, 255},
+		{60, 60, 60, 255},
+		{255, 215, 0, 255},
+		{40, 40, 40, 255},
+		{100, 70, 40, 255},
+		{150, 110, 0, 255},
+		// unit outlines, labels and health bars
+		{30, 30, 30, 255},
+		{120, 0, 0, 255},
+		{40, 200, 40, 255},
+		// players without a tribe or tribe color
+		{0, 0, 0, 255},
+		{128, 128, 128, 255},
+		// city names, caption, legend and chart
+		{255, 255, 255, 255},
+		chartBackgroundColor,
+		chartGridColor,
+		chartTextColor,
+		chartCursorColor,
+		{180, 180, 180, 255},
+	}
+)
+
+type ReplayGranularity string
+
+const (
+	// One frame after every player has moved
+	ReplayGranularityRound ReplayGranularity = "round"
+	// One frame after each player's turn
+	ReplayGranularityPlayer ReplayGranularity = "player"
+	// One frame after every action
+	ReplayGranularityAction ReplayGranularity = "action"
+)
+
+type ReplayOptions struct {
+	RenderOptions
+	// How often a frame is drawn, defaults to once per round
+	Granularity ReplayGranularity
+	// Defaults to GIF
+	Format ReplayFormat
+	// Only used for WebP, which is lossless unless this is set
+	Lossy bool
+	// 1 to 100 for lossy WebP, higher keeps more detail. Zero uses webp.DefaultQuality.
+	Quality int
+	// Only used for lossless WebP. Reduce each frame to this many colors for a smaller file, or zero to keep every color.
+	ReduceColors int
+	// Time each frame is shown in hundredths of a second, defaults to GIF_DELAY or ACTION_GIF_DELAY
+	Delay int
+	// Time the last frame is shown in hundredths of a second, defaults to the frame delay
+	FinalDelay int
+	// Number of times the replay is played, zero repeats forever
+	LoopCount int
+	// Show frames with city events for longer and skip quickly through frames where nothing changed
+	Adaptive bool
+	// Only store the area that changed since the previous frame to get a smaller file
+	FrameDiff bool
+	// First turn shown in the replay, defaults to the first turn
+	FromTurn int
+	// Last turn shown in the replay, defaults to MaxTurn
+	ToTurn int
+	// Defaults to only the map
+	Layout ReplayLayout
+}
+
+type ReplayLayout string
+
+const (
+	// Only the map is drawn
+	ReplayLayoutMap ReplayLayout = "map"
+	// The territory chart is drawn to the right of the map and grows with the replay
+	ReplayLayoutChart ReplayLayout = "chart"
 )
 
+func ParseReplayLayout(s string) (ReplayLayout, error) {
+	switch ReplayLayout(s) {
+	case "", ReplayLayoutMap:
+		return ReplayLayoutMap, nil
+	case ReplayLayoutChart:
+		return ReplayLayoutChart, nil
+	}
+	return "", fmt.Errorf("invalid replay layout %v, must be map or chart", s)
+}
+
+func ParseReplayGranularity(s string) (ReplayGranularity, error) {
+	switch ReplayGranularity(s) {
+	case "", ReplayGranularityRound:
+		return ReplayGranularityRound, nil
+	case ReplayGranularityPlayer:
+		return ReplayGranularityPlayer, nil
+	case ReplayGranularityAction:
+		return ReplayGranularityAction, nil
+	}
+	return "", fmt.Errorf("invalid replay granularity %v, must be round, player or action", s)
+}
+
 var (
-	drawMapColors = []color.Color{
-		// terrain colors
-		color.RGBA{95, 149, 149, 255},
-		color.RGBA{47, 74, 93, 255},
-		color.RGBA{105, 125, 54, 255},
-		color.RGBA{238, 249, 255, 255},
-		// tribe colors
-		color.RGBA{0, 0, 0, 255},
-		color.RGBA{54, 226, 170, 255},
-		color.RGBA{243, 131, 129, 255},
-		color.RGBA{53, 37, 20, 255},
-		color.RGBA{255, 0, 153, 255},
-		color.RGBA{153, 102, 0, 255},
-		color.RGBA{0, 0, 255, 255},
-		color.RGBA{0, 255, 0, 255},
-		color.RGBA{171, 59, 214, 255},
-		color.RGBA{255, 255, 0, 255},
-		color.RGBA{39, 92, 74, 255},
-		color.RGBA{255, 255, 255, 255},
-		color.RGBA{204, 0, 0, 255},
-		color.RGBA{125, 35, 28, 255},
-		color.RGBA{255, 153, 0, 255},
-		color.RGBA{182, 161, 133, 255},
-		color.RGBA{194, 253, 0, 255},
-		color.RGBA{128, 128, 128, 255},
-		// mountain and forest colors
-		color.RGBA{89, 90, 86, 255},
-		color.RGBA{234, 244, 253, 255},
-		color.RGBA{53, 72, 44, 255},
+	gameModeNames = map[int]string{
+		0: "Custom",
+		1: "Perfection",
+		2: "Domination",
+		3: "Sandbox",
+		4: "Tutorial",
+		5: "Glory",
+		6: "Might",
 	}
 )
 
+const (
+	adaptiveEventDelayMultiplier = 3
+	adaptiveQuietDelayDivisor    = 5
+	// Browsers show GIF frames with shorter delays at a much slower speed
+	minFrameDelay = 2
+)
+
+// Map state shown after all actions before ActionEnd are applied
+type replayFrame struct {
+	Turn int
+	// Player whose turn is shown, or zero if the frame covers the whole round
+	PlayerId  int
+	ActionEnd int
+}
+
+const (
+	ReplayEventCaptureCity  = "capture"
+	ReplayEventFoundCity    = "found"
+	ReplayEventBorderGrowth = "border"
+)
+
+// City changes that happened while the actions were applied
+type ReplayEvent struct {
+	Type        string `json:"type"`
+	Turn        int    `json:"turn"`
+	PlayerId    int    `json:"playerId"`
+	Coordinates [2]int `json:"coordinates"`
+	CityName    string `json:"cityName,omitempty"`
+}
+
 type MapCoordinates struct {
 	Coordinates [2]int
 }
 
+// Tile state of the replay as the actions are applied in order.
+// The save data is only read, the actions are applied to a copy of its initial tiles.
+type replayState struct {
+	saveData         *polytopiamapmodel.PolytopiaSaveOutput
+	tileData         [][]polytopiamapmodel.TileData
+	currentTileData  [][]polytopiamapmodel.TileData
+	cityTerritoryMap map[string][]MapCoordinates
+	// Units alive at the end of the game, by unit id
+	finalUnits map[uint32]polytopiamapmodel.UnitData
+	// Index of the last action performed by each unit id
+	lastUnitAction map[uint32]int
+	// Trained units get a placeholder id until a later action reveals the real one
+	nextUnitId uint32
+	// Only city captures are known, so cities claim their final border right away
+	useFinalBorders bool
+	// Units killed and lost by each player in the attacks applied so far
+	unitsKilled map[int]int
+	unitsLost   map[int]int
+
+	replayActions []actions.Action
+	// Actions before this index have been applied
+	actionIndex int
+	// Events since the last frame was drawn
+	events []ReplayEvent
+	// Whether any action since the last frame changed the map
+	changed bool
+}
+
 func buildCityToTerritoryMap(saveData *polytopiamapmodel.PolytopiaSaveOutput) map[string][]MapCoordinates {
 	mapHeight := saveData.MapHeight
 	mapWidth := saveData.MapWidth
@@ -76,90 +252,681 @@ func buildCityToTerritoryMap(saveData *polytopiamapmodel.PolytopiaSaveOutput) ma
 	return cityTerritoryMap
 }
 
-func captureCityTiles(
-	saveData *polytopiamapmodel.PolytopiaSaveOutput,
-	cityTerritoryMap map[string][]MapCoordinates,
-	cityCoordinates0 int,
-	cityCoordinates1 int,
-	newPlayerId int,
-) {
-	cityKey := fmt.Sprintf("(%v,%v)", cityCoordinates0, cityCoordinates1)
-	citySurroundingTiles := cityTerritoryMap[cityKey]
-	for tileIndex := 0; tileIndex < len(citySurroundingTiles); tileIndex++ {
-		tile := citySurroundingTiles[tileIndex]
-		saveData.TileData[tile.Coordinates[1]][tile.Coordinates[0]].Owner = newPlayerId // int(captureEvent.PlayerId)
-	}
+func isWaterTerrain(terrain int) bool {
+	// water and ocean
+	return terrain == 1 || terrain == 2
 }
 
-func DrawReplay(saveData *polytopiamapmodel.PolytopiaSaveOutput, outputFilename string) {
-	cityTerritoryMap := buildCityToTerritoryMap(saveData)
+func newReplayState(saveData *polytopiamapmodel.PolytopiaSaveOutput, replayActions []actions.Action, useFinalBorders bool) *replayState {
+	state := &replayState{
+		replayActions:    replayActions,
+		saveData:         saveData,
+		tileData:         copyTileData(saveData.InitialTileData),
+		currentTileData:  saveData.TileData,
+		cityTerritoryMap: buildCityToTerritoryMap(saveData),
+		finalUnits:       make(map[uint32]polytopiamapmodel.UnitData),
+		lastUnitAction:   make(map[uint32]int),
+		useFinalBorders:  useFinalBorders,
+		unitsKilled:      make(map[int]int),
+		unitsLost:        make(map[int]int),
+	}
 
-	// Build initial map from turn 1
-	currentTileData := saveData.TileData
-	saveData.TileData = saveData.InitialTileData
+	for i := 0; i < saveData.MapHeight; i++ {
+		for j := 0; j < saveData.MapWidth; j++ {
+			for _, unit := range []*polytopiamapmodel.UnitData{saveData.TileData[i][j].Unit, saveData.TileData[i][j].PassengerUnit} {
+				if unit == nil {
+					continue
+				}
+				state.finalUnits[unit.Id] = *unit
+				if unit.Id >= state.nextUnitId {
+					state.nextUnitId = unit.Id + 1
+				}
+			}
+			if initialUnit := saveData.InitialTileData[i][j].Unit; initialUnit != nil && initialUnit.Id >= state.nextUnitId {
+				state.nextUnitId = initialUnit.Id + 1
+			}
+		}
+	}
+
+	for _, action := range replayActions {
+		switch data := action.Data.(type) {
+		case *polytopiamapmodel.ActionMove:
+			state.lastUnitAction[data.UnitId] = action.Index
+		case *polytopiamapmodel.ActionAttack:
+			state.lastUnitAction[data.UnitId] = action.Index
+		case *polytopiamapmodel.ActionCaptureCity:
+			state.lastUnitAction[data.UnitId] = action.Index
+		}
+	}
 
 	// Assign territory around capitals to be consistent with current tile data
 	for i := 0; i < saveData.MapHeight; i++ {
 		for j := 0; j < saveData.MapWidth; j++ {
-			tileData := saveData.TileData[i][j]
+			tileData := state.tileData[i][j]
 
 			if tileData.Capital > 0 {
 				capitalCoordinates := tileData.CapitalCoordinates
-				captureCityTiles(saveData, cityTerritoryMap, int(capitalCoordinates[0]), int(capitalCoordinates[1]), int(tileData.Capital))
+				state.captureCityTiles(int(capitalCoordinates[0]), int(capitalCoordinates[1]), int(tileData.Capital))
 			}
 		}
 	}
 
-	outGif := &gif.GIF{}
-	quantizer := quantize.MedianCutQuantizer{NumColor: 256}
-	var mapPalette color.Palette
-	mapPalette = drawMapColors
+	return state
+}
+
+func (state *replayState) getTile(coordinates [2]uint32) *polytopiamapmodel.TileData {
+	x := int(coordinates[0])
+	y := int(coordinates[1])
+	if y < 0 || y >= state.saveData.MapHeight || x < 0 || x >= state.saveData.MapWidth {
+		return nil
+	}
+	return &state.tileData[y][x]
+}
+
+// Explored tiles stay explored, so a tile is only revealed if the player has explored it by the end of the game
+func (state *replayState) revealTile(x int, y int, playerId int) {
+	if y < 0 || y >= state.saveData.MapHeight || x < 0 || x >= state.saveData.MapWidth {
+		return
+	}
+	tileData := &state.tileData[y][x]
+	if isTileExplored(*tileData, playerId) || !isTileExplored(state.currentTileData[y][x], playerId) {
+		return
+	}
+	tileData.PlayerVisibility = append(tileData.PlayerVisibility, playerId)
+}
+
+// Reveal the tiles a unit can see from its position
+func (state *replayState) revealUnitSight(coordinates [2]uint32, playerId int) {
+	tileData := state.getTile(coordinates)
+	if tileData == nil {
+		return
+	}
+	sightRadius := unitSightRadius
+	if tileData.Terrain == terrainMountain {
+		sightRadius = mountainSightRadius
+	}
+	x := int(coordinates[0])
+	y := int(coordinates[1])
+	for i := y - sightRadius; i <= y+sightRadius; i++ {
+		for j := x - sightRadius; j <= x+sightRadius; j++ {
+			state.revealTile(j, i, playerId)
+		}
+	}
+}
+
+func (state *replayState) getCityBorderSize(cityCoordinates0 int, cityCoordinates1 int) int {
+	tileData := state.tileData[cityCoordinates1][cityCoordinates0]
+	if state.useFinalBorders {
+		tileData = state.currentTileData[cityCoordinates1][cityCoordinates0]
+	}
+	if tileData.ImprovementData == nil || tileData.ImprovementData.BorderSize < 1 {
+		return 1
+	}
+	return tileData.ImprovementData.BorderSize
+}
 
-	for turn := 1; turn <= saveData.MaxTurn; turn++ {
-		fmt.Println("Drawing frame for turn", turn)
+// Claim the tiles of the city's final territory that are inside its current border
+func (state *replayState) captureCityTiles(cityCoordinates0 int, cityCoordinates1 int, newPlayerId int) {
+	borderSize := state.getCityBorderSize(cityCoordinates0, cityCoordinates1)
 
-		captureEvents := make([]polytopiamapmodel.ActionCaptureCity, 0)
-		_, ok := saveData.TurnCaptureMap[turn]
-		if ok {
-			captureEvents = saveData.TurnCaptureMap[turn]
+	cityKey := fmt.Sprintf("(%v,%v)", cityCoordinates0, cityCoordinates1)
+	citySurroundingTiles := state.cityTerritoryMap[cityKey]
+	for tileIndex := 0; tileIndex < len(citySurroundingTiles); tileIndex++ {
+		tile := citySurroundingTiles[tileIndex]
+		distance := max(abs(tile.Coordinates[0]-cityCoordinates0), abs(tile.Coordinates[1]-cityCoordinates1))
+		if distance > borderSize {
+			continue
 		}
+		state.tileData[tile.Coordinates[1]][tile.Coordinates[0]].Owner = newPlayerId
+		state.revealTile(tile.Coordinates[0], tile.Coordinates[1], newPlayerId)
+	}
+}
+
+func (state *replayState) addEvent(eventType string, turn int, playerId int, coordinates [2]uint32) {
+	cityName := ""
+	if tileData := state.getTile(coordinates); tileData != nil && tileData.ImprovementData != nil {
+		cityName = tileData.ImprovementData.CityName
+	}
+	state.events = append(state.events, ReplayEvent{
+		Type:        eventType,
+		Turn:        turn,
+		PlayerId:    playerId,
+		Coordinates: [2]int{int(coordinates[0]), int(coordinates[1])},
+		CityName:    cityName,
+	})
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// A unit is gone after an attack if it doesn't survive to the end of the game and never acts again
+func (state *replayState) isUnitKilled(unitId uint32, actionIndex int) bool {
+	if _, ok := state.finalUnits[unitId]; ok {
+		return false
+	}
+	lastActionIndex, ok := state.lastUnitAction[unitId]
+	return !ok || lastActionIndex <= actionIndex
+}
+
+func (state *replayState) applyBuild(action actions.Action, build *polytopiamapmodel.ActionBuild) {
+	tileData := state.getTile(build.Coordinates)
+	if tileData == nil {
+		return
+	}
+	finalTileData := state.currentTileData[build.Coordinates[1]][build.Coordinates[0]]
+	improvementType := int(build.ImprovementType)
+
+	if improvementType == improvementCity {
+		cityName := ""
+		if finalTileData.ImprovementData != nil {
+			cityName = finalTileData.ImprovementData.CityName
+		}
+		tileData.ImprovementExists = true
+		tileData.ImprovementType = improvementCity
+		tileData.ImprovementData = &polytopiamapmodel.ImprovementData{Level: 1, BorderSize: 1, CityName: cityName}
+		tileData.Owner = action.PlayerId
+		state.captureCityTiles(int(build.Coordinates[0]), int(build.Coordinates[1]), action.PlayerId)
+		state.addEvent(ReplayEventFoundCity, action.Turn, action.PlayerId, build.Coordinates)
+		return
+	}
+
+	// Roads, bridges and water routes share the tile with other improvements
+	switch improvementType {
+	case improvementRoad, improvementBridge:
+		tileData.HasRoad = true
+		return
+	case improvementWaterRoute:
+		tileData.HasWaterRoute = true
+		return
+	}
+
+	tileData.ImprovementExists = true
+	tileData.ImprovementType = improvementType
+	tileData.ImprovementData = &polytopiamapmodel.ImprovementData{Level: 1}
+}
+
+func (state *replayState) applyTrain(action actions.Action, train *polytopiamapmodel.ActionTrain) {
+	tileData := state.getTile(train.Position)
+	if tileData == nil {
+		return
+	}
+
+	unitId := state.nextUnitId
+	finalUnit := state.currentTileData[train.Position[1]][train.Position[0]].Unit
+	if finalUnit != nil && int(finalUnit.Owner) == action.PlayerId && finalUnit.UnitType == train.UnitType {
+		// The unit never moved after it was trained
+		unitId = finalUnit.Id
+	} else {
+		state.nextUnitId++
+	}
+
+	tileData.Unit = &polytopiamapmodel.UnitData{
+		Id:                 unitId,
+		Owner:              uint8(action.PlayerId),
+		UnitType:           train.UnitType,
+		CurrentCoordinates: [2]int32{int32(train.Position[0]), int32(train.Position[1])},
+		HomeCoordinates:    [2]int32{int32(train.Position[0]), int32(train.Position[1])},
+		Health:             uint16(getUnitTypeInfo(int(train.UnitType)).MaxHealth * 10),
+	}
+	tileData.PassengerUnit = nil
+	state.revealUnitSight(train.Position, action.PlayerId)
+}
+
+func (state *replayState) applyMove(move *polytopiamapmodel.ActionMove) {
+	oldTileData := state.getTile(move.OldPosition)
+	newTileData := state.getTile(move.NewPosition)
+	if oldTileData == nil || newTileData == nil {
+		return
+	}
+
+	unit := oldTileData.Unit
+	passengerUnit := oldTileData.PassengerUnit
+	oldTileData.Unit = nil
+	oldTileData.PassengerUnit = nil
+	if unit == nil {
+		// The unit wasn't tracked, such as units that appear outside of the decoded actions
+		finalUnit, ok := state.finalUnits[move.UnitId]
+		if !ok {
+			return
+		}
+		unit = &finalUnit
+	} else {
+		movedUnit := *unit
+		unit = &movedUnit
+	}
+	unit.Id = move.UnitId
+	unit.CurrentCoordinates = [2]int32{int32(move.NewPosition[0]), int32(move.NewPosition[1])}
+
+	if isWaterTerrain(newTileData.Terrain) && passengerUnit == nil && !getUnitTypeInfo(int(unit.UnitType)).Naval {
+		// Embark
+		passengerUnit = unit
+		unit = &polytopiamapmodel.UnitData{
+			Id:                 unit.Id,
+			Owner:              unit.Owner,
+			UnitType:           unitBoat,
+			CurrentCoordinates: unit.CurrentCoordinates,
+			HomeCoordinates:    unit.HomeCoordinates,
+			Health:             unit.Health,
+		}
+	} else if !isWaterTerrain(newTileData.Terrain) && passengerUnit != nil {
+		// Disembark
+		passengerUnit.Id = unit.Id
+		passengerUnit.CurrentCoordinates = unit.CurrentCoordinates
+		unit = passengerUnit
+		passengerUnit = nil
+	}
+
+	newTileData.Unit = unit
+	newTileData.PassengerUnit = passengerUnit
+	state.revealUnitSight(move.NewPosition, int(move.PlayerId))
+}
+
+func (state *replayState) applyAttack(action actions.Action, attack *polytopiamapmodel.ActionAttack) {
+	if attackerTileData := state.getTile(attack.Origin); attackerTileData != nil && attackerTileData.Unit != nil {
+		attackerTileData.Unit.Id = attack.UnitId
+	}
+	state.revealUnitSight(attack.Origin, action.PlayerId)
+
+	targetTileData := state.getTile(attack.Target)
+	if targetTileData == nil || targetTileData.Unit == nil {
+		return
+	}
+	if state.isUnitKilled(targetTileData.Unit.Id, action.Index) {
+		state.unitsKilled[action.PlayerId]++
+		state.unitsLost[int(targetTileData.Unit.Owner)]++
+		targetTileData.Unit = nil
+		targetTileData.PassengerUnit = nil
+	}
+}
+
+func (state *replayState) applyCaptureCity(action actions.Action, captureEvent *polytopiamapmodel.ActionCaptureCity) {
+	tileData := state.getTile(captureEvent.Coordinates)
+	if tileData == nil {
+		return
+	}
+	cityCoordinates0 := int(captureEvent.Coordinates[0])
+	cityCoordinates1 := int(captureEvent.Coordinates[1])
+
+	// Assign city to new owner
+	tileData.Owner = int(captureEvent.PlayerId)
+
+	// Villages become cities once they are captured
+	finalTileData := state.currentTileData[cityCoordinates1][cityCoordinates0]
+	if tileData.ImprovementData == nil {
+		tileData.ImprovementExists = true
+		tileData.ImprovementType = improvementCity
+		tileData.ImprovementData = &polytopiamapmodel.ImprovementData{Level: 1, BorderSize: 1}
+	}
+
+	// If city hasn't been claimed by any player, assign the city name
+	if tileData.ImprovementData.CityName == "" && finalTileData.ImprovementData != nil {
+		tileData.ImprovementData.CityName = finalTileData.ImprovementData.CityName
+	}
+
+	state.captureCityTiles(cityCoordinates0, cityCoordinates1, int(captureEvent.PlayerId))
+	state.addEvent(ReplayEventCaptureCity, action.Turn, int(captureEvent.PlayerId), captureEvent.Coordinates)
+}
 
-		for eventNum := 0; eventNum < len(captureEvents); eventNum++ {
-			captureEvent := captureEvents[eventNum]
-			cityCoordinates0 := int(captureEvent.Coordinates[0])
-			cityCoordinates1 := int(captureEvent.Coordinates[1])
-			fmt.Println("Captured city at tile", captureEvent.Coordinates, "by player", int(captureEvent.PlayerId))
+func (state *replayState) applyCityReward(action actions.Action, cityReward *polytopiamapmodel.ActionCityReward) {
+	tileData := state.getTile(cityReward.Coordinates)
+	if tileData == nil || tileData.ImprovementData == nil || int(cityReward.Reward) != cityRewardBorderGrowth {
+		return
+	}
+	tileData.ImprovementData.BorderSize = state.getCityBorderSize(int(cityReward.Coordinates[0]), int(cityReward.Coordinates[1])) + 1
+	state.captureCityTiles(int(cityReward.Coordinates[0]), int(cityReward.Coordinates[1]), tileData.Owner)
+	state.addEvent(ReplayEventBorderGrowth, action.Turn, tileData.Owner, cityReward.Coordinates)
+}
+
+// Update the tile state with a single action. Actions that don't change the map, such as research, are ignored.
+func (state *replayState) applyAction(action actions.Action) {
+	switch data := action.Data.(type) {
+	case *polytopiamapmodel.ActionBuild:
+		state.applyBuild(action, data)
+	case *polytopiamapmodel.ActionAttack:
+		state.applyAttack(action, data)
+	case *polytopiamapmodel.ActionTrain:
+		state.applyTrain(action, data)
+	case *polytopiamapmodel.ActionMove:
+		state.applyMove(data)
+	case *polytopiamapmodel.ActionCaptureCity:
+		state.applyCaptureCity(action, data)
+	case *polytopiamapmodel.ActionDestroyImprovement:
+		if tileData := state.getTile(data.Coordinates); tileData != nil {
+			tileData.ImprovementExists = false
+			tileData.ImprovementType = -1
+			tileData.ImprovementData = nil
+		}
+	case *polytopiamapmodel.ActionCityReward:
+		state.applyCityReward(action, data)
+	case *polytopiamapmodel.ActionPromote:
+		if tileData := state.getTile(data.Coordinates); tileData != nil && tileData.Unit != nil {
+			tileData.Unit.PromotionLevel++
+			// Promoted units are fully healed and gain 5 extra hit points
+			tileData.Unit.Health = uint16(getUnitTypeInfo(int(tileData.Unit.UnitType)).MaxHealth*10 + 50)
+		}
+	case *polytopiamapmodel.ActionExamineRuins:
+		if tileData := state.getTile(data.Coordinates); tileData != nil && tileData.ImprovementType == improvementRuin {
+			tileData.ImprovementExists = false
+			tileData.ImprovementType = -1
+			tileData.ImprovementData = nil
+		}
+	case *polytopiamapmodel.ActionUpgrade:
+		if tileData := state.getTile(data.Coordinates); tileData != nil && tileData.Unit != nil {
+			tileData.Unit.UnitType = data.UnitType
+		}
+	case *polytopiamapmodel.ActionCityLevelUp:
+		if tileData := state.getTile(data.Coordinates); tileData != nil && tileData.ImprovementData != nil {
+			tileData.ImprovementData.Level++
+		}
+	default:
+		return
+	}
+	state.changed = true
+}
 
-			// Assign city to new owner
-			saveData.TileData[cityCoordinates1][cityCoordinates0].Owner = int(captureEvent.PlayerId)
+func isEndTurnAction(action actions.Action) bool {
+	_, ok := action.Data.(*polytopiamapmodel.ActionEndTurn)
+	return ok
+}
 
-			// If city hasn't been claimed by any player, assign the city name
-			if saveData.TileData[cityCoordinates1][cityCoordinates0].ImprovementData != nil &&
-				saveData.TileData[cityCoordinates1][cityCoordinates0].ImprovementData.CityName == "" {
-				saveData.TileData[cityCoordinates1][cityCoordinates0].ImprovementData.CityName = currentTileData[cityCoordinates1][cityCoordinates0].ImprovementData.CityName
+// Split the actions into frames. Every round gets at least one frame even if nothing happened.
+func buildReplayFrames(replayActions []actions.Action, maxTurn int, granularity ReplayGranularity) []replayFrame {
+	frames := make([]replayFrame, 0)
+	actionIndex := 0
+	for turn := 1; turn <= maxTurn; turn++ {
+		turnStart := len(frames)
+		playerTurnEnded := true
+		for ; actionIndex < len(replayActions) && replayActions[actionIndex].Turn <= turn; actionIndex++ {
+			action := replayActions[actionIndex]
+			if action.PlayerId == actions.EndOfRoundPlayerId {
+				continue
 			}
 
-			captureCityTiles(saveData, cityTerritoryMap, cityCoordinates0, cityCoordinates1, int(captureEvent.PlayerId))
+			switch granularity {
+			case ReplayGranularityPlayer:
+				// Saves without end turn actions are split whenever a different player acts
+				lastFrame := len(frames) - 1
+				if !playerTurnEnded && lastFrame >= turnStart && frames[lastFrame].PlayerId == action.PlayerId {
+					frames[lastFrame].ActionEnd = actionIndex + 1
+				} else {
+					frames = append(frames, replayFrame{Turn: turn, PlayerId: action.PlayerId, ActionEnd: actionIndex + 1})
+				}
+				playerTurnEnded = isEndTurnAction(action)
+			case ReplayGranularityAction:
+				if !isEndTurnAction(action) {
+					frames = append(frames, replayFrame{Turn: turn, PlayerId: action.PlayerId, ActionEnd: actionIndex + 1})
+				}
+			}
 		}
 
-		mapImage := DrawMap(saveData)
-		bounds := mapImage.Bounds()
-		palettedImage := image.NewPaletted(bounds, nil)
-		if mapPalette == nil {
-			quantizer.Quantize(palettedImage, bounds, mapImage, image.ZP)
-			mapPalette = palettedImage.Palette
+		if len(frames) == turnStart {
+			frames = append(frames, replayFrame{Turn: turn, ActionEnd: actionIndex})
 		} else {
-			quantizer.UseExistingPalette(palettedImage, bounds, mapImage, image.ZP, mapPalette)
+			// Anything left at the end of the round belongs to the last frame
+			frames[len(frames)-1].ActionEnd = actionIndex
 		}
+	}
+	return frames
+}
 
-		outGif.Image = append(outGif.Image, palettedImage)
-		outGif.Delay = append(outGif.Delay, GIF_DELAY)
+func getPlayerName(saveData *polytopiamapmodel.PolytopiaSaveOutput, playerId int) string {
+	for i := 0; i < len(saveData.PlayerData); i++ {
+		playerData := saveData.PlayerData[i]
+		if playerData.PlayerId == playerId && playerData.Name != "" {
+			return playerData.Name
+		}
 	}
+	return fmt.Sprintf("Player %v", playerId)
+}
 
-	outputFile, _ := os.OpenFile(outputFilename, os.O_WRONLY|os.O_CREATE, 0600)
-	defer outputFile.Close()
-	err := gif.EncodeAll(outputFile, outGif)
+func getGameModeName(gameMode int) string {
+	gameModeName, ok := gameModeNames[gameMode]
+	if !ok {
+		return fmt.Sprintf("Game mode %v", gameMode)
+	}
+	return gameModeName
+}
+
+func getPlayerTribeName(saveData *polytopiamapmodel.PolytopiaSaveOutput, playerId int) string {
+	tribe, ok := saveData.OwnerTribeMap[playerId]
+	if !ok {
+		return getPlayerName(saveData, playerId)
+	}
+	return getTribeName(tribe)
+}
+
+// Text for the events shown in the header, or an empty string for events that are only in the manifest
+func getReplayEventText(saveData *polytopiamapmodel.PolytopiaSaveOutput, event ReplayEvent) string {
+	cityName := event.CityName
+	if cityName == "" {
+		cityName = fmt.Sprintf("the city at %v,%v", event.Coordinates[0], event.Coordinates[1])
+	}
+	switch event.Type {
+	case ReplayEventCaptureCity:
+		return fmt.Sprintf("%v captured %v", getPlayerTribeName(saveData, event.PlayerId), cityName)
+	case ReplayEventFoundCity:
+		return fmt.Sprintf("%v founded %v", getPlayerTribeName(saveData, event.PlayerId), cityName)
+	}
+	return ""
+}
+
+// The turn and whose turn it is, followed by the game mode, map name and the city events of the turn so far
+func getReplayCaption(saveData *polytopiamapmodel.PolytopiaSaveOutput, frame replayFrame, turnEvents []ReplayEvent) string {
+	lines := make([]string, 0)
+	if frame.PlayerId == 0 {
+		lines = append(lines, fmt.Sprintf("Turn %v/%v", frame.Turn, saveData.MaxTurn))
+	} else {
+		lines = append(lines, fmt.Sprintf("Turn %v/%v - %v", frame.Turn, saveData.MaxTurn, getPlayerName(saveData, frame.PlayerId)))
+	}
+
+	gameInfo := getGameModeName(int(saveData.MapHeaderOutput.MapHeaderInput.GameModeBase))
+	if saveData.MapHeaderOutput.MapName != "" {
+		gameInfo += " - " + saveData.MapHeaderOutput.MapName
+	}
+	lines = append(lines, gameInfo)
+
+	for _, event := range turnEvents {
+		if eventText := getReplayEventText(saveData, event); eventText != "" {
+			lines = append(lines, eventText)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Turns shown in the replay, which must be between 1 and MaxTurn
+func getReplayTurnRange(options ReplayOptions, maxTurn int) (int, int, error) {
+	fromTurn := options.FromTurn
+	if fromTurn <= 0 {
+		fromTurn = 1
+	}
+	toTurn := options.ToTurn
+	if toTurn <= 0 {
+		toTurn = maxTurn
+	}
+	if fromTurn > maxTurn || toTurn > maxTurn {
+		return 0, 0, fmt.Errorf("turns %v to %v are outside of the game, which has %v turns", fromTurn, toTurn, maxTurn)
+	}
+	if fromTurn > toTurn {
+		return 0, 0, fmt.Errorf("from turn %v is after to turn %v", fromTurn, toTurn)
+	}
+	return fromTurn, toTurn, nil
+}
+
+// If replayActions is nil, only the city captures stored in the save data are replayed.
+// Turns before the turn range are applied right away, so the first frame shows the map as it stood on that turn.
+func newReplay(saveData *polytopiamapmodel.PolytopiaSaveOutput, replayActions []actions.Action, options ReplayOptions) (*replayState, []replayFrame, error) {
+	fromTurn, toTurn, err := getReplayTurnRange(options, saveData.MaxTurn)
 	if err != nil {
-		log.Fatal("Error while saving GIF:", err)
+		return nil, nil, err
+	}
+
+	useFinalBorders := false
+	if replayActions == nil {
+		replayActions = actions.BuildCaptureActions(saveData)
+		useFinalBorders = true
+	}
+	state := newReplayState(saveData, replayActions, useFinalBorders)
+
+	frames := make([]replayFrame, 0)
+	for _, frame := range buildReplayFrames(replayActions, saveData.MaxTurn, options.Granularity) {
+		if frame.Turn < fromTurn {
+			state.applyActions(frame.ActionEnd)
+		} else if frame.Turn <= toTurn {
+			frames = append(frames, frame)
+		}
+	}
+	return state, frames, nil
+}
+
+// Map as it stood at the end of the turn, built by replaying the actions up to that turn.
+// If replayActions is nil, only the city captures stored in the save data are replayed.
+func BuildGameState(saveData *polytopiamapmodel.PolytopiaSaveOutput, replayActions []actions.Action, turn int) (*GameState, error) {
+	if turn <= 0 {
+		return nil, fmt.Errorf("invalid turn %v, must be at least 1", turn)
+	}
+	state, frames, err := newReplay(saveData, replayActions, ReplayOptions{FromTurn: turn, ToTurn: turn})
+	if err != nil {
+		return nil, err
+	}
+	return state.advanceToFrame(frames[len(frames)-1]), nil
+}
+
+// Apply the actions before actionEnd that haven't been applied yet
+func (state *replayState) applyActions(actionEnd int) {
+	for ; state.actionIndex < actionEnd; state.actionIndex++ {
+		state.applyAction(state.replayActions[state.actionIndex])
+	}
+}
+
+// Player data with the kills and losses of the attacks applied so far instead of the totals at the end of the game
+func (state *replayState) getPlayerData() []polytopiamapmodel.PlayerData {
+	playerData := slices.Clone(state.saveData.PlayerData)
+	for i := range playerData {
+		playerData[i].TotalUnitsKilled = state.unitsKilled[playerData[i].PlayerId]
+		playerData[i].TotalUnitsLost = state.unitsLost[playerData[i].PlayerId]
+	}
+	return playerData
+}
+
+// Apply the actions up to the end of the frame and return the game state at that point.
+// Frames must be advanced in order.
+func (state *replayState) advanceToFrame(frame replayFrame) *GameState {
+	state.events = make([]ReplayEvent, 0)
+	state.changed = false
+	state.applyActions(frame.ActionEnd)
+	return &GameState{
+		Turn:       frame.Turn,
+		PlayerId:   frame.PlayerId,
+		TileData:   copyTileData(state.tileData),
+		Events:     state.events,
+		Changed:    state.changed,
+		saveData:   state.saveData,
+		playerData: state.getPlayerData(),
+	}
+}
+
+func getFrameDelay(options ReplayOptions, gameState *GameState, isLastFrame bool) int {
+	if isLastFrame && options.FinalDelay > 0 {
+		return options.FinalDelay
+	}
+
+	delay := options.Delay
+	if delay <= 0 {
+		delay = GIF_DELAY
+		if options.Granularity == ReplayGranularityAction {
+			delay = ACTION_GIF_DELAY
+		}
+	}
+
+	if options.Adaptive {
+		if len(gameState.Events) > 0 {
+			delay *= adaptiveEventDelayMultiplier
+		} else if !gameState.Changed {
+			delay /= adaptiveQuietDelayDivisor
+		}
+	}
+	return max(delay, minFrameDelay)
+}
+
+// Draws the image for a replay frame. It is called from several workers at once.
+type frameDrawer func(gameState *GameState, caption string) (image.Image, error)
+
+// Every frame has the same terrain, so warnings are only logged for the first frame drawn
+func newFrameDrawer(options ReplayOptions, territoryStats []TerritoryStats) frameDrawer {
+	var logOnce sync.Once
+	return func(gameState *GameState, caption string) (image.Image, error) {
+		frameOptions := options.RenderOptions
+		frameOptions.Caption = caption
+		// The save only has the score at the end of the game
+		frameOptions.HideScore = true
+		frameOptions.Logger = nil
+		logOnce.Do(func() {
+			frameOptions.Logger = options.Logger
+		})
+		mapImage, err := DrawMap(gameState.SaveData(), frameOptions)
+		if err != nil || options.Layout != ReplayLayoutChart {
+			return mapImage, err
+		}
+		return drawMapWithChart(mapImage, gameState, territoryStats, options.RenderOptions)
+	}
+}
+
+// The chart layout needs the territory of the whole game, which is counted with a separate replay
+// before any frame is drawn. Other layouts don't need any stats.
+func (state *replayState) getLayoutTerritoryStats(options ReplayOptions) []TerritoryStats {
+	if options.Layout != ReplayLayoutChart {
+		return nil
+	}
+	statsState := newReplayState(state.saveData, state.replayActions, state.useFinalBorders)
+	return statsState.buildTerritoryStats(buildReplayFrames(state.replayActions, state.saveData.MaxTurn, ReplayGranularityRound))
+}
+
+// Encode the replay as a GIF, APNG or WebP to any writer, such as an HTTP response or a buffer.
+// If replayActions is nil, only the city captures stored in the save data are replayed.
+// WebP frames are only written as they are drawn if the writer can seek, such as a file,
+// otherwise they are kept in memory until the end.
+func EncodeReplay(w io.Writer, saveData *polytopiamapmodel.PolytopiaSaveOutput, replayActions []actions.Action, options ReplayOptions) error {
+	state, frames, err := newReplay(saveData, replayActions, options)
+	if err != nil {
+		return err
+	}
+
+	encoder, err := newFrameEncoder(w, options, len(frames), buildReplayPalette(saveData))
+	if err != nil {
+		return err
+	}
+
+	drawFrame := newFrameDrawer(options, state.getLayoutTerritoryStats(options))
+	err = state.drawFrames(frames, drawFrame, func(frameIndex int, mapImage image.Image, gameState *GameState) error {
+		frameDelay := getFrameDelay(options, gameState, frameIndex == len(frames)-1)
+		return encoder.WriteFrame(mapImage, frameDelay)
+	})
+	if err != nil {
+		return err
+	}
+
+	return encoder.Close()
+}
+
+// The replay is written to a temporary file next to the output and only renamed once it is complete,
+// so invalid options or a failed render leave any existing replay untouched
+func DrawReplay(saveData *polytopiamapmodel.PolytopiaSaveOutput, replayActions []actions.Action, outputFilename string, options ReplayOptions) error {
+	outputFile, err := os.CreateTemp(filepath.Dir(outputFilename), filepath.Base(outputFilename)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to open %v: %w", outputFilename, err)
+	}
+	defer os.Remove(outputFile.Name())
+	defer outputFile.Close()
+
+	if err := EncodeReplay(outputFile, saveData, replayActions, options); err != nil {
+		return err
+	}
+	if err := outputFile.Close(); err != nil {
+		return err
 	}
+	return os.Rename(outputFile.Name(), outputFilename)
 }
@@ -0,0 +1,433 @@
+package graphics
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/samuelyuan/PolytopiaMapImage/actions"
+	polytopiamapmodel "github.com/samuelyuan/polytopiamapmodelgo"
+)
+
+const (
+	testMapSize  = 5
+	testMaxTurn  = 4
+	testWarrior  = 2
+	testFarm     = 5
+	testPlayer1  = 1
+	testPlayer2  = 2
+	testUnitId   = 10
+	testEnemyId  = 11
+	testTrainId  = 12
+	testTribe1   = 13
+	testTribe2   = 7
+	testCityName = "Lito"
+)
+
+func buildTestTiles() [][]polytopiamapmodel.TileData {
+	tileData := make([][]polytopiamapmodel.TileData, testMapSize)
+	for i := 0; i < testMapSize; i++ {
+		tileData[i] = make([]polytopiamapmodel.TileData, testMapSize)
+		for j := 0; j < testMapSize; j++ {
+			terrain := 3
+			if j == 0 {
+				terrain = 2
+			}
+			tileData[i][j] = polytopiamapmodel.TileData{
+				WorldCoordinates:   [2]int{j, i},
+				Terrain:            terrain,
+				CapitalCoordinates: [2]int{-1, -1},
+				ResourceType:       -1,
+				ImprovementType:    -1,
+				PlayerVisibility:   []int{testPlayer1},
+			}
+		}
+	}
+	return tileData
+}
+
+func addTestCity(tileData [][]polytopiamapmodel.TileData, x int, y int, owner int, cityName string) {
+	tileData[y][x].ImprovementExists = true
+	tileData[y][x].ImprovementType = improvementCity
+	tileData[y][x].ImprovementData = &polytopiamapmodel.ImprovementData{Level: 1, BorderSize: 1, CityName: cityName}
+	tileData[y][x].Capital = owner
+	for i := y - 1; i <= y+1; i++ {
+		for j := x - 1; j <= x+1; j++ {
+			tileData[i][j].Owner = owner
+			tileData[i][j].CapitalCoordinates = [2]int{x, y}
+		}
+	}
+}
+
+// Player 1 starts with a city and a warrior, and captures the village of player 2 by the end of the game.
+// A new save is built on every call, so one can be compared to another that went through a replay.
+func buildTestSave() *polytopiamapmodel.PolytopiaSaveOutput {
+	initialTileData := buildTestTiles()
+	addTestCity(initialTileData, 1, 1, testPlayer1, testCityName)
+	addTestCity(initialTileData, 3, 3, 0, "")
+	initialTileData[1][2].Unit = &polytopiamapmodel.UnitData{Id: testUnitId, Owner: testPlayer1, UnitType: testWarrior, Health: 100}
+	initialTileData[3][2].Unit = &polytopiamapmodel.UnitData{Id: testEnemyId, Owner: testPlayer2, UnitType: testWarrior, Health: 100}
+
+	tileData := buildTestTiles()
+	addTestCity(tileData, 1, 1, testPlayer1, testCityName)
+	addTestCity(tileData, 3, 3, testPlayer1, "Beeqa")
+	tileData[3][3].Capital = 0
+	tileData[3][3].Unit = &polytopiamapmodel.UnitData{Id: testUnitId, Owner: testPlayer1, UnitType: testWarrior, Health: 60, PromotionLevel: 1}
+	tileData[1][1].Unit = &polytopiamapmodel.UnitData{Id: testTrainId, Owner: testPlayer1, UnitType: testWarrior, Health: 100}
+	tileData[2][1].ImprovementExists = true
+	tileData[2][1].ImprovementType = testFarm
+	tileData[2][1].ImprovementData = &polytopiamapmodel.ImprovementData{Level: 1}
+	tileData[4][0].Unit = &polytopiamapmodel.UnitData{Id: 20, Owner: testPlayer2, UnitType: 13, Health: 100}
+	tileData[4][0].PassengerUnit = &polytopiamapmodel.UnitData{Id: 20, Owner: testPlayer2, UnitType: testWarrior, Health: 100}
+
+	return &polytopiamapmodel.PolytopiaSaveOutput{
+		MapHeight:       testMapSize,
+		MapWidth:        testMapSize,
+		MaxTurn:         testMaxTurn,
+		InitialTileData: initialTileData,
+		TileData:        tileData,
+		OwnerTribeMap:   map[int]int{testPlayer1: testTribe1, testPlayer2: testTribe2},
+		PlayerData: []polytopiamapmodel.PlayerData{
+			{PlayerId: testPlayer1, Name: "Alice", Tribe: testTribe1, Score: 1200, TotalUnitsKilled: 1, OverrideColor: []int{0, 0, 0, 255}},
+			{PlayerId: testPlayer2, Name: "Bob", Tribe: testTribe2, Score: 900, TotalUnitsLost: 1, OverrideColor: []int{0, 0, 0, 255}},
+		},
+	}
+}
+
+func buildTestAction(index int, turn int, playerId int, data interface{}) actions.Action {
+	return actions.Action{Index: index, Turn: turn, PlayerId: playerId, Data: data}
+}
+
+// Player 2 doesn't do anything in turn 2, and there are no actions after turn 3
+func buildTestActions() []actions.Action {
+	replayActions := []actions.Action{
+		// Turn 1
+		buildTestAction(0, 1, testPlayer1, &polytopiamapmodel.ActionMove{PlayerId: testPlayer1, OldPosition: [2]uint32{2, 1}, NewPosition: [2]uint32{2, 2}, UnitId: testUnitId}),
+		buildTestAction(0, 1, testPlayer1, &polytopiamapmodel.ActionBuild{PlayerId: testPlayer1, ImprovementType: testFarm, Coordinates: [2]uint32{1, 2}}),
+		buildTestAction(0, 1, testPlayer1, &polytopiamapmodel.ActionEndTurn{PlayerId: testPlayer1}),
+		buildTestAction(0, 1, testPlayer2, &polytopiamapmodel.ActionMove{PlayerId: testPlayer2, OldPosition: [2]uint32{2, 3}, NewPosition: [2]uint32{3, 2}, UnitId: testEnemyId}),
+		buildTestAction(0, 1, testPlayer2, &polytopiamapmodel.ActionEndTurn{PlayerId: testPlayer2}),
+		buildTestAction(0, 1, actions.EndOfRoundPlayerId, &polytopiamapmodel.ActionEndTurn{PlayerId: actions.EndOfRoundPlayerId}),
+		// Turn 2
+		buildTestAction(0, 2, testPlayer1, &polytopiamapmodel.ActionAttack{PlayerId: testPlayer1, UnitId: testUnitId, Origin: [2]uint32{2, 2}, Target: [2]uint32{3, 2}}),
+		buildTestAction(0, 2, testPlayer1, &polytopiamapmodel.ActionTrain{PlayerId: testPlayer1, UnitType: testWarrior, Position: [2]uint32{1, 1}}),
+		buildTestAction(0, 2, testPlayer1, &polytopiamapmodel.ActionEndTurn{PlayerId: testPlayer1}),
+		buildTestAction(0, 2, actions.EndOfRoundPlayerId, &polytopiamapmodel.ActionEndTurn{PlayerId: actions.EndOfRoundPlayerId}),
+		// Turn 3
+		buildTestAction(0, 3, testPlayer1, &polytopiamapmodel.ActionMove{PlayerId: testPlayer1, OldPosition: [2]uint32{2, 2}, NewPosition: [2]uint32{3, 3}, UnitId: testUnitId}),
+		buildTestAction(0, 3, testPlayer1, &polytopiamapmodel.ActionCaptureCity{PlayerId: testPlayer1, UnitId: testUnitId, Coordinates: [2]uint32{3, 3}}),
+		buildTestAction(0, 3, testPlayer1, &polytopiamapmodel.ActionPromote{PlayerId: testPlayer1, Coordinates: [2]uint32{3, 3}}),
+		buildTestAction(0, 3, testPlayer1, &polytopiamapmodel.ActionEndTurn{PlayerId: testPlayer1}),
+		buildTestAction(0, 3, testPlayer2, &polytopiamapmodel.ActionEndTurn{PlayerId: testPlayer2}),
+		buildTestAction(0, 3, actions.EndOfRoundPlayerId, &polytopiamapmodel.ActionEndTurn{PlayerId: actions.EndOfRoundPlayerId}),
+	}
+	for i := range replayActions {
+		replayActions[i].Index = i
+	}
+	return replayActions
+}
+
+// Game state of every frame, advanced in order
+func buildTestGameStates(t *testing.T, saveData *polytopiamapmodel.PolytopiaSaveOutput, options ReplayOptions) []*GameState {
+	state, frames, err := newReplay(saveData, buildTestActions(), options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gameStates := make([]*GameState, 0, len(frames))
+	for _, frame := range frames {
+		gameStates = append(gameStates, state.advanceToFrame(frame))
+	}
+	return gameStates
+}
+
+func TestReplayLeavesSaveDataUnchanged(t *testing.T) {
+	saveData := buildTestSave()
+	options := ReplayOptions{Granularity: ReplayGranularityAction}
+
+	if err := EncodeReplay(io.Discard, saveData, buildTestActions(), options); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveReplayFrames(saveData, buildTestActions(), t.TempDir(), options); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := BuildGameState(saveData, buildTestActions(), 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := BuildTerritoryStats(saveData, nil); err != nil {
+		t.Fatal(err)
+	}
+	buildTestGameStates(t, saveData, options)
+
+	if !reflect.DeepEqual(saveData, buildTestSave()) {
+		t.Fatal("replay modified the save data")
+	}
+}
+
+func TestAdvanceToFrameIsDeterministic(t *testing.T) {
+	for _, granularity := range []ReplayGranularity{ReplayGranularityRound, ReplayGranularityPlayer, ReplayGranularityAction} {
+		saveData := buildTestSave()
+		options := ReplayOptions{Granularity: granularity}
+		first := buildTestGameStates(t, saveData, options)
+		second := buildTestGameStates(t, saveData, options)
+		if !reflect.DeepEqual(first, second) {
+			t.Fatalf("replay with %v granularity built different game states for the same actions", granularity)
+		}
+
+		lastTileData := first[len(first)-1].TileData
+		if unit := lastTileData[3][3].Unit; unit == nil || unit.Id != testUnitId || unit.PromotionLevel != 1 {
+			t.Fatalf("replay with %v granularity ended with unit %+v in the captured city", granularity, unit)
+		}
+		if owner := lastTileData[3][3].Owner; owner != testPlayer1 {
+			t.Fatalf("replay with %v granularity ended with the captured city owned by %v", granularity, owner)
+		}
+		if lastTileData[2][3].Unit != nil {
+			t.Fatalf("replay with %v granularity didn't remove the killed unit", granularity)
+		}
+	}
+}
+
+// Every unit and improvement belongs to a single game state, so drawing one state can't see changes from another
+func TestGameStatesDontSharePointers(t *testing.T) {
+	saveData := buildTestSave()
+	gameStates := buildTestGameStates(t, saveData, ReplayOptions{Granularity: ReplayGranularityAction})
+
+	owners := make(map[interface{}]string)
+	addPointers := func(name string, tileData [][]polytopiamapmodel.TileData) {
+		for i := range tileData {
+			for j := range tileData[i] {
+				tile := &tileData[i][j]
+				for _, pointer := range []interface{}{tile.Unit, tile.PassengerUnit, tile.ImprovementData} {
+					if reflect.ValueOf(pointer).IsNil() {
+						continue
+					}
+					if owner, ok := owners[pointer]; ok {
+						t.Fatalf("tile %v,%v of %v shares a pointer with %v", j, i, name, owner)
+					}
+					owners[pointer] = name
+				}
+			}
+		}
+	}
+	addPointers("the save data", saveData.TileData)
+	addPointers("the initial save data", saveData.InitialTileData)
+	for i, gameState := range gameStates {
+		addPointers(fmt.Sprintf("game state %v", i), gameState.TileData)
+	}
+}
+
+func TestCopyTileDataIsDeep(t *testing.T) {
+	tileData := buildTestSave().TileData
+	copiedTileData := copyTileData(tileData)
+	if !reflect.DeepEqual(tileData, copiedTileData) {
+		t.Fatal("copied tiles are different from the original")
+	}
+
+	copiedTileData[3][3].Unit.Health = 1
+	copiedTileData[4][0].PassengerUnit.UnitType = 1
+	copiedTileData[3][3].ImprovementData.CityName = "Copy"
+	copiedTileData[1][1].Owner = testPlayer2
+	copiedTileData[2][2].PlayerVisibility[0] = testPlayer2
+	if !reflect.DeepEqual(tileData, buildTestSave().TileData) {
+		t.Fatal("changing the copied tiles changed the original")
+	}
+}
+
+func TestBuildReplayFrames(t *testing.T) {
+	testCases := []struct {
+		name        string
+		granularity ReplayGranularity
+		expected    []replayFrame
+	}{
+		{
+			name:        "round",
+			granularity: ReplayGranularityRound,
+			expected: []replayFrame{
+				{Turn: 1, ActionEnd: 6},
+				{Turn: 2, ActionEnd: 10},
+				{Turn: 3, ActionEnd: 16},
+				{Turn: 4, ActionEnd: 16},
+			},
+		},
+		{
+			// Player 2 has no actions in turn 2, so it doesn't get a frame
+			name:        "player",
+			granularity: ReplayGranularityPlayer,
+			expected: []replayFrame{
+				{Turn: 1, PlayerId: testPlayer1, ActionEnd: 3},
+				{Turn: 1, PlayerId: testPlayer2, ActionEnd: 6},
+				{Turn: 2, PlayerId: testPlayer1, ActionEnd: 10},
+				{Turn: 3, PlayerId: testPlayer1, ActionEnd: 14},
+				{Turn: 3, PlayerId: testPlayer2, ActionEnd: 16},
+				{Turn: 4, ActionEnd: 16},
+			},
+		},
+		{
+			// End turn actions don't get their own frame
+			name:        "action",
+			granularity: ReplayGranularityAction,
+			expected: []replayFrame{
+				{Turn: 1, PlayerId: testPlayer1, ActionEnd: 1},
+				{Turn: 1, PlayerId: testPlayer1, ActionEnd: 2},
+				{Turn: 1, PlayerId: testPlayer2, ActionEnd: 6},
+				{Turn: 2, PlayerId: testPlayer1, ActionEnd: 7},
+				{Turn: 2, PlayerId: testPlayer1, ActionEnd: 10},
+				{Turn: 3, PlayerId: testPlayer1, ActionEnd: 11},
+				{Turn: 3, PlayerId: testPlayer1, ActionEnd: 12},
+				{Turn: 3, PlayerId: testPlayer1, ActionEnd: 16},
+				{Turn: 4, ActionEnd: 16},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		result := buildReplayFrames(buildTestActions(), testMaxTurn, testCase.granularity)
+		if !reflect.DeepEqual(result, testCase.expected) {
+			t.Fatalf("%v frames are %+v, expected %+v", testCase.name, result, testCase.expected)
+		}
+	}
+}
+
+// Every round gets a frame even without any actions
+func TestBuildReplayFramesWithoutActions(t *testing.T) {
+	if result := buildReplayFrames(nil, 0, ReplayGranularityRound); len(result) != 0 {
+		t.Fatalf("game without turns has frames %+v, expected none", result)
+	}
+
+	for _, granularity := range []ReplayGranularity{ReplayGranularityRound, ReplayGranularityPlayer, ReplayGranularityAction} {
+		result := buildReplayFrames(nil, 2, granularity)
+		expected := []replayFrame{{Turn: 1}, {Turn: 2}}
+		if !reflect.DeepEqual(result, expected) {
+			t.Fatalf("%v frames without actions are %+v, expected %+v", granularity, result, expected)
+		}
+	}
+}
+
+func TestGetReplayTurnRange(t *testing.T) {
+	testCases := []struct {
+		fromTurn         int
+		toTurn           int
+		expectedFromTurn int
+		expectedToTurn   int
+		expectError      bool
+	}{
+		{fromTurn: 0, toTurn: 0, expectedFromTurn: 1, expectedToTurn: testMaxTurn},
+		{fromTurn: -1, toTurn: -1, expectedFromTurn: 1, expectedToTurn: testMaxTurn},
+		{fromTurn: 2, toTurn: 0, expectedFromTurn: 2, expectedToTurn: testMaxTurn},
+		{fromTurn: 0, toTurn: 3, expectedFromTurn: 1, expectedToTurn: 3},
+		{fromTurn: 2, toTurn: 2, expectedFromTurn: 2, expectedToTurn: 2},
+		{fromTurn: 3, toTurn: 2, expectError: true},
+		{fromTurn: testMaxTurn + 1, toTurn: 0, expectError: true},
+		{fromTurn: 0, toTurn: testMaxTurn + 1, expectError: true},
+	}
+
+	for _, testCase := range testCases {
+		fromTurn, toTurn, err := getReplayTurnRange(ReplayOptions{FromTurn: testCase.fromTurn, ToTurn: testCase.toTurn}, testMaxTurn)
+		if testCase.expectError {
+			if err == nil {
+				t.Fatalf("expected an error for turns %v to %v", testCase.fromTurn, testCase.toTurn)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fromTurn != testCase.expectedFromTurn || toTurn != testCase.expectedToTurn {
+			t.Fatalf("turns %v to %v are %v to %v, expected %v to %v",
+				testCase.fromTurn, testCase.toTurn, fromTurn, toTurn, testCase.expectedFromTurn, testCase.expectedToTurn)
+		}
+	}
+
+	if _, _, err := getReplayTurnRange(ReplayOptions{}, 0); err == nil {
+		t.Fatal("expected an error for a game without turns")
+	}
+}
+
+// Turns before the range are applied before the first frame, and turns after it are left out
+func TestNewReplayTurnRange(t *testing.T) {
+	state, frames, err := newReplay(buildTestSave(), buildTestActions(), ReplayOptions{FromTurn: 2, ToTurn: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []replayFrame{{Turn: 2, ActionEnd: 10}, {Turn: 3, ActionEnd: 16}}
+	if !reflect.DeepEqual(frames, expected) {
+		t.Fatalf("frames are %+v, expected %+v", frames, expected)
+	}
+	if state.actionIndex != 6 {
+		t.Fatalf("%v actions were applied before the first frame, expected the 6 actions of turn 1", state.actionIndex)
+	}
+	if unit := state.tileData[2][2].Unit; unit == nil || unit.Id != testUnitId {
+		t.Fatalf("unit %+v is at the end of its turn 1 move, expected unit %v", unit, testUnitId)
+	}
+}
+
+// Player 1 starts out only knowing the left of the map and explores the rest except the bottom right corner
+func TestReplayRevealsExploredTiles(t *testing.T) {
+	saveData := buildTestSave()
+	for i := 0; i < testMapSize; i++ {
+		for j := 0; j < testMapSize; j++ {
+			if j > 2 {
+				saveData.InitialTileData[i][j].PlayerVisibility = nil
+			}
+		}
+	}
+	saveData.TileData[4][4].PlayerVisibility = nil
+
+	gameStates := buildTestGameStates(t, saveData, ReplayOptions{})
+	testCases := []struct {
+		turn     int
+		revealed [][2]int
+		hidden   [][2]int
+	}{
+		// The warrior moved next to the right of the map, and the enemy warrior doesn't reveal anything for player 1
+		{turn: 1, revealed: [][2]int{{3, 1}, {3, 2}, {3, 3}}, hidden: [][2]int{{3, 0}, {3, 4}, {4, 2}}},
+		// The warrior captured the village, but the bottom right corner was never explored
+		{turn: 3, revealed: [][2]int{{3, 4}, {4, 2}, {4, 3}}, hidden: [][2]int{{3, 0}, {4, 0}, {4, 1}, {4, 4}}},
+	}
+	for _, testCase := range testCases {
+		tileData := gameStates[testCase.turn-1].TileData
+		for _, coordinates := range testCase.revealed {
+			if !isTileExplored(tileData[coordinates[1]][coordinates[0]], testPlayer1) {
+				t.Fatalf("tile %v is hidden at the end of turn %v, expected it to be explored", coordinates, testCase.turn)
+			}
+		}
+		for _, coordinates := range testCase.hidden {
+			if isTileExplored(tileData[coordinates[1]][coordinates[0]], testPlayer1) {
+				t.Fatalf("tile %v is explored at the end of turn %v, expected it to be hidden", coordinates, testCase.turn)
+			}
+		}
+	}
+
+	// Player 2 doesn't explore anything by the end of the game
+	for _, gameState := range gameStates {
+		if isTileExplored(gameState.TileData[2][3], testPlayer2) {
+			t.Fatalf("tile the enemy warrior moved to is explored by player 2 at turn %v", gameState.Turn)
+		}
+	}
+}
+
+// The warrior of player 1 kills the enemy warrior in turn 2
+func TestReplayCountsKillsAndLosses(t *testing.T) {
+	gameStates := buildTestGameStates(t, buildTestSave(), ReplayOptions{})
+	expected := [][2]string{{"0/0", "0/0"}, {"1/0", "0/1"}, {"1/0", "0/1"}, {"1/0", "0/1"}}
+	for i, gameState := range gameStates {
+		rows := buildLegendRows(gameState.SaveData(), true)
+		if len(rows) != 2 {
+			t.Fatalf("legend at turn %v has %v rows, expected 2", gameState.Turn, len(rows))
+		}
+		// Without the score, the players stay in player order and the last column is kills and losses
+		for row, playerId := range []int{testPlayer1, testPlayer2} {
+			cells := rows[row].cells
+			playerName := getPlayerName(gameState.saveData, playerId)
+			if len(cells) != len(legendHeadersWithoutScore) || cells[0] != playerName || cells[3] != expected[i][row] {
+				t.Fatalf("legend row %v at turn %v is %v, expected %v with kills and losses %v",
+					row, gameState.Turn, cells, playerName, expected[i][row])
+			}
+		}
+	}
+
+	rows := buildLegendRows(buildTestSave(), false)
+	if len(rows[0].cells) != len(legendHeaders) || rows[0].cells[2] != "1200" || rows[0].cells[4] != "1/0" {
+		t.Fatalf("legend row of the final save is %v, expected the final score and kills", rows[0].cells)
+	}
+}
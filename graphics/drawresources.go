@@ -0,0 +1,134 @@
+package graphics
+
+import (
+	polytopiamapmodel "github.com/samuelyuan/polytopiamapmodelgo"
+)
+
+const (
+	ResourceGame     = 1
+	ResourceFruit    = 2
+	ResourceFish     = 3
+	ResourceCrop     = 4
+	ResourceMetal    = 5
+	ResourceWhale    = 6
+	ResourceStarfish = 7
+	ResourceSpores   = 8
+)
+
+func drawGame(dc canvas, centerX float64, centerY float64) {
+	// antlers
+	dc.DrawLine(centerX-radius*0.12, centerY, centerX-radius*0.2, centerY-radius*0.2)
+	dc.DrawLine(centerX+radius*0.12, centerY, centerX+radius*0.2, centerY-radius*0.2)
+	dc.SetRGB255(222, 196, 150) // tan
+	setLineWidth(dc, 2.0)
+	dc.Stroke()
+	setLineWidth(dc, 1.0)
+
+	dc.DrawCircle(centerX, centerY, radius*0.14)
+	dc.SetRGB255(139, 90, 43) // brown
+	dc.Fill()
+}
+
+func drawFruit(dc canvas, centerX float64, centerY float64) {
+	dc.DrawCircle(centerX-radius*0.1, centerY+radius*0.06, radius*0.09)
+	dc.DrawCircle(centerX+radius*0.1, centerY+radius*0.06, radius*0.09)
+	dc.DrawCircle(centerX, centerY-radius*0.1, radius*0.09)
+	dc.SetRGB255(214, 52, 110) // berry pink
+	dc.Fill()
+}
+
+func drawFish(dc canvas, centerX float64, centerY float64) {
+	dc.DrawEllipse(centerX, centerY, radius*0.16, radius*0.09)
+	dc.MoveTo(centerX+radius*0.12, centerY)
+	dc.LineTo(centerX+radius*0.26, centerY+radius*0.1)
+	dc.LineTo(centerX+radius*0.26, centerY-radius*0.1)
+	dc.ClosePath()
+	dc.SetRGB255(190, 225, 240) // pale blue
+	dc.Fill()
+}
+
+func drawCrop(dc canvas, centerX float64, centerY float64) {
+	for k := -1; k <= 1; k++ {
+		stalkX := centerX + float64(k)*radius*0.12
+		dc.DrawLine(stalkX, centerY-radius*0.18, stalkX, centerY+radius*0.18)
+	}
+	dc.SetRGB255(240, 200, 60) // wheat yellow
+	setLineWidth(dc, 2.5)
+	dc.Stroke()
+	setLineWidth(dc, 1.0)
+}
+
+func drawMetal(dc canvas, centerX float64, centerY float64) {
+	dc.DrawRegularPolygon(6, centerX, centerY, radius*0.16, 0)
+	dc.SetRGB255(160, 165, 175) // steel gray
+	dc.FillPreserve()
+	dc.SetRGB255(70, 70, 80)
+	dc.Stroke()
+}
+
+func drawWhale(dc canvas, centerX float64, centerY float64) {
+	dc.DrawEllipse(centerX, centerY, radius*0.25, radius*0.12)
+	dc.SetRGB255(60, 80, 110) // slate blue
+	dc.Fill()
+
+	dc.DrawCircle(centerX-radius*0.12, centerY, radius*0.03)
+	dc.SetRGB255(255, 255, 255)
+	dc.Fill()
+}
+
+func drawStarfish(dc canvas, centerX float64, centerY float64) {
+	dc.DrawRegularPolygon(5, centerX, centerY, radius*0.16, 0)
+	dc.SetRGB255(255, 140, 70) // coral orange
+	dc.Fill()
+}
+
+func drawSpores(dc canvas, centerX float64, centerY float64) {
+	dc.DrawCircle(centerX-radius*0.1, centerY, radius*0.07)
+	dc.DrawCircle(centerX+radius*0.08, centerY+radius*0.08, radius*0.06)
+	dc.DrawCircle(centerX+radius*0.06, centerY-radius*0.1, radius*0.05)
+	dc.SetRGB255(150, 90, 200) // spore purple
+	dc.Fill()
+}
+
+func drawResource(dc canvas, imageX float64, imageY float64, resourceType int) {
+	centerX := imageX + (radius / 2)
+	centerY := imageY + (radius / 2)
+
+	switch resourceType {
+	case ResourceGame:
+		drawGame(dc, centerX, centerY)
+	case ResourceFruit:
+		drawFruit(dc, centerX, centerY)
+	case ResourceFish:
+		drawFish(dc, centerX, centerY)
+	case ResourceCrop:
+		drawCrop(dc, centerX, centerY)
+	case ResourceMetal:
+		drawMetal(dc, centerX, centerY)
+	case ResourceWhale:
+		drawWhale(dc, centerX, centerY)
+	case ResourceStarfish:
+		drawStarfish(dc, centerX, centerY)
+	case ResourceSpores:
+		drawSpores(dc, centerX, centerY)
+	default:
+		// unknown resource
+		dc.DrawCircle(centerX, centerY, radius*0.08)
+		dc.SetRGB255(200, 200, 200)
+		dc.Fill()
+	}
+}
+
+func drawResources(dc canvas, layout mapLayout, saveData *polytopiamapmodel.PolytopiaSaveOutput) {
+	for _, tileIndex := range layout.drawOrder {
+		i, j := tileIndex[0], tileIndex[1]
+		tileData := saveData.TileData[i][j]
+		if !tileData.ResourceExists {
+			continue
+		}
+
+		x, y := layout.getImagePosition(i, j)
+		setClass(dc, "resource")
+		drawResource(dc, x, y, tileData.ResourceType)
+	}
+}
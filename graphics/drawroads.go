@@ -0,0 +1,87 @@
+package graphics
+
+import (
+	polytopiamapmodel "github.com/samuelyuan/polytopiamapmodelgo"
+)
+
+// Cities connect to any adjacent road, so they act as nodes in the road network
+func isRoadNode(tileData polytopiamapmodel.TileData) bool {
+	return tileData.HasRoad || (tileData.ImprovementData != nil && tileData.ImprovementType == improvementCity)
+}
+
+func drawNetwork(
+	dc canvas,
+	layout mapLayout,
+	saveData *polytopiamapmodel.PolytopiaSaveOutput,
+	isNode func(tileData polytopiamapmodel.TileData) bool,
+	isStart func(tileData polytopiamapmodel.TileData) bool,
+) {
+	mapHeight := layout.mapHeight
+	mapWidth := layout.mapWidth
+	for i := 0; i < mapHeight; i++ {
+		for j := 0; j < mapWidth; j++ {
+			if !isStart(saveData.TileData[i][j]) {
+				continue
+			}
+
+			centerX1, centerY1 := layout.getTileCenter(i, j)
+
+			connected := false
+			neighbors := getNeighbors(j, i)
+			for n := 0; n < len(neighbors); n++ {
+				newX := neighbors[n][0]
+				newY := neighbors[n][1]
+				if newX < 0 || newY < 0 || newX >= mapWidth || newY >= mapHeight {
+					continue
+				}
+				if !isNode(saveData.TileData[newY][newX]) {
+					continue
+				}
+				connected = true
+
+				// Only draw each segment once to avoid overlapping dashes
+				if isStart(saveData.TileData[newY][newX]) && (newY < i || (newY == i && newX < j)) {
+					continue
+				}
+
+				centerX2, centerY2 := layout.getTileCenter(newY, newX)
+				dc.DrawLine(centerX1, centerY1, centerX2, centerY2)
+				dc.Stroke()
+			}
+
+			// An isolated segment is still visible as a dot
+			if !connected {
+				dc.DrawCircle(centerX1, centerY1, radius*0.08)
+				dc.Fill()
+			}
+		}
+	}
+}
+
+func drawRoads(dc canvas, layout mapLayout, saveData *polytopiamapmodel.PolytopiaSaveOutput) {
+	setClass(dc, "road")
+	dc.SetRGB255(176, 132, 82) // dirt brown
+	setLineWidth(dc, radius*0.12)
+	drawNetwork(dc, layout, saveData, isRoadNode, func(tileData polytopiamapmodel.TileData) bool {
+		return tileData.HasRoad
+	})
+	setLineWidth(dc, 1.0)
+}
+
+// Water routes end at ports and cities on the coast
+func isWaterRouteNode(tileData polytopiamapmodel.TileData) bool {
+	return tileData.HasWaterRoute ||
+		(tileData.ImprovementData != nil && (tileData.ImprovementType == improvementPort || tileData.ImprovementType == improvementCity))
+}
+
+func drawWaterRoutes(dc canvas, layout mapLayout, saveData *polytopiamapmodel.PolytopiaSaveOutput) {
+	setClass(dc, "water-route")
+	dc.SetRGB255(230, 240, 250) // foam white
+	setLineWidth(dc, radius*0.08)
+	setDash(dc, radius*0.2, radius*0.13)
+	drawNetwork(dc, layout, saveData, isWaterRouteNode, func(tileData polytopiamapmodel.TileData) bool {
+		return tileData.HasWaterRoute
+	})
+	setDash(dc)
+	setLineWidth(dc, 1.0)
+}
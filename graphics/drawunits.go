@@ -0,0 +1,169 @@
+package graphics
+
+import (
+	"image/color"
+	"math"
+
+	polytopiamapmodel "github.com/samuelyuan/polytopiamapmodelgo"
+)
+
+type unitTypeInfo struct {
+	Name         string
+	Abbreviation string
+	MaxHealth    int // in game hit points, the save file stores health multiplied by 10
+	Naval        bool
+}
+
+var (
+	unitTypeInfoMap = map[int]unitTypeInfo{
+		1:  {Name: "Scout", Abbreviation: "Sc", MaxHealth: 5},
+		2:  {Name: "Warrior", Abbreviation: "W", MaxHealth: 10},
+		3:  {Name: "Rider", Abbreviation: "R", MaxHealth: 10},
+		4:  {Name: "Knight", Abbreviation: "K", MaxHealth: 10},
+		5:  {Name: "Defender", Abbreviation: "D", MaxHealth: 15},
+		6:  {Name: "Ship", Abbreviation: "Sh", MaxHealth: 10, Naval: true},
+		7:  {Name: "Battleship", Abbreviation: "Bs", MaxHealth: 10, Naval: true},
+		8:  {Name: "Catapult", Abbreviation: "C", MaxHealth: 10},
+		9:  {Name: "Archer", Abbreviation: "A", MaxHealth: 10},
+		10: {Name: "Mind Bender", Abbreviation: "M", MaxHealth: 10},
+		11: {Name: "Swordsman", Abbreviation: "S", MaxHealth: 15},
+		12: {Name: "Giant", Abbreviation: "G", MaxHealth: 40},
+		13: {Name: "Boat", Abbreviation: "B", MaxHealth: 10, Naval: true},
+		14: {Name: "Polytaur", Abbreviation: "P", MaxHealth: 15},
+		15: {Name: "Navalon", Abbreviation: "N", MaxHealth: 30, Naval: true},
+		16: {Name: "Dragon Egg", Abbreviation: "E", MaxHealth: 10},
+		17: {Name: "Baby Dragon", Abbreviation: "Bd", MaxHealth: 15},
+		18: {Name: "Fire Dragon", Abbreviation: "F", MaxHealth: 20},
+		19: {Name: "Amphibian", Abbreviation: "Am", MaxHealth: 10},
+		20: {Name: "Tridention", Abbreviation: "T", MaxHealth: 15},
+		21: {Name: "Mooni", Abbreviation: "Mo", MaxHealth: 10},
+		22: {Name: "Battle Sled", Abbreviation: "Bl", MaxHealth: 15},
+		23: {Name: "Ice Fortress", Abbreviation: "If", MaxHealth: 20},
+		24: {Name: "Ice Archer", Abbreviation: "Ia", MaxHealth: 10},
+		25: {Name: "Crab", Abbreviation: "Cr", MaxHealth: 40, Naval: true},
+		26: {Name: "Gaami", Abbreviation: "Ga", MaxHealth: 30},
+		27: {Name: "Hexapod", Abbreviation: "H", MaxHealth: 5},
+		28: {Name: "Doomux", Abbreviation: "Dx", MaxHealth: 20},
+		29: {Name: "Phychi", Abbreviation: "Ph", MaxHealth: 5},
+		30: {Name: "Kiton", Abbreviation: "Ki", MaxHealth: 15},
+		31: {Name: "Exida", Abbreviation: "Ex", MaxHealth: 10},
+		32: {Name: "Centipede", Abbreviation: "Ce", MaxHealth: 20},
+		33: {Name: "Segment", Abbreviation: "Sg", MaxHealth: 10},
+		34: {Name: "Raft", Abbreviation: "Ra", MaxHealth: 10, Naval: true},
+		35: {Name: "Scout Ship", Abbreviation: "Ss", MaxHealth: 10, Naval: true},
+		36: {Name: "Rammer", Abbreviation: "Rm", MaxHealth: 10, Naval: true},
+		37: {Name: "Bomber", Abbreviation: "Bo", MaxHealth: 10, Naval: true},
+	}
+)
+
+func getUnitTypeInfo(unitType int) unitTypeInfo {
+	unitInfo, ok := unitTypeInfoMap[unitType]
+	if !ok {
+		// default
+		return unitTypeInfo{Name: "Unknown", Abbreviation: "?", MaxHealth: 10}
+	}
+	return unitInfo
+}
+
+// Black text on light colors and white text on dark colors
+func getContrastColor(c color.RGBA) color.RGBA {
+	luminance := 0.299*float64(c.R) + 0.587*float64(c.G) + 0.114*float64(c.B)
+	if luminance > 140 {
+		return color.RGBA{0, 0, 0, 255}
+	}
+	return color.RGBA{255, 255, 255, 255}
+}
+
+func getUnitHealthFraction(unit *polytopiamapmodel.UnitData, unitInfo unitTypeInfo) float64 {
+	maxHealth := unitInfo.MaxHealth * 10
+	if unit.PromotionLevel > 0 {
+		// Veteran units gain 5 extra hit points
+		maxHealth += 50
+	}
+	return math.Max(0, math.Min(1, float64(unit.Health)/float64(maxHealth)))
+}
+
+func drawUnitGlyph(dc canvas, imageX float64, imageY float64, unitColor color.RGBA, naval bool, label string) {
+	centerX := imageX + (radius / 2)
+	centerY := imageY + (radius / 2)
+
+	if naval {
+		// draw hull
+		dc.MoveTo(centerX-radius*0.4, centerY-radius*0.15)
+		dc.LineTo(centerX+radius*0.4, centerY-radius*0.15)
+		dc.LineTo(centerX+radius*0.25, centerY+radius*0.25)
+		dc.LineTo(centerX-radius*0.25, centerY+radius*0.25)
+		dc.ClosePath()
+	} else {
+		dc.DrawCircle(centerX, centerY, radius*0.3)
+	}
+	dc.SetRGB255(int(unitColor.R), int(unitColor.G), int(unitColor.B))
+	dc.FillPreserve()
+	// Only the body has the owner's class, the parts drawn on top of it have their own
+	setClass(dc, "unit-outline")
+	dc.SetRGB255(30, 30, 30) // outline
+	setLineWidth(dc, 1.0)
+	dc.Stroke()
+
+	setClass(dc, "unit-label")
+	textColor := getContrastColor(unitColor)
+	dc.SetRGB255(int(textColor.R), int(textColor.G), int(textColor.B))
+	drawStringAnchored(dc, label, centerX, centerY, 0.5, 0.35)
+}
+
+// The bar and marker are placed in the inner box of the tile, so they stay inside diamonds
+func drawHealthBar(dc canvas, boxX float64, boxY float64, boxWidth float64, boxHeight float64, healthFraction float64) {
+	barX := boxX + boxWidth*0.15
+	barY := boxY + boxHeight*0.85
+	barWidth := boxWidth * 0.7
+	barHeight := radius * 0.1
+
+	setClass(dc, "unit-health")
+	dc.DrawRectangle(barX, barY, barWidth, barHeight)
+	dc.SetRGB255(120, 0, 0) // dark red
+	dc.Fill()
+
+	setClass(dc, "unit-health-remaining")
+	dc.DrawRectangle(barX, barY, barWidth*healthFraction, barHeight)
+	dc.SetRGB255(40, 200, 40) // green
+	dc.Fill()
+}
+
+func drawVeteranMarker(dc canvas, boxX float64, boxY float64, boxWidth float64, boxHeight float64) {
+	setClass(dc, "unit-veteran")
+	dc.DrawRegularPolygon(5, boxX+boxWidth*0.85, boxY+boxHeight*0.15, radius*0.12, 0)
+	dc.SetRGB255(255, 215, 0) // gold
+	dc.Fill()
+}
+
+func drawUnits(dc canvas, layout mapLayout, saveData *polytopiamapmodel.PolytopiaSaveOutput) {
+	for _, tileIndex := range layout.drawOrder {
+		i, j := tileIndex[0], tileIndex[1]
+		tile := saveData.TileData[i][j]
+		if tile.Unit == nil {
+			continue
+		}
+
+		x, y := layout.getImagePosition(i, j)
+
+		unit := tile.Unit
+		unitInfo := getUnitTypeInfo(int(unit.UnitType))
+		unitColor := getPlayerColor(saveData, int(unit.Owner))
+
+		// Boats show the unit they are carrying
+		label := unitInfo.Abbreviation
+		healthUnitInfo := unitInfo
+		if tile.PassengerUnit != nil {
+			healthUnitInfo = getUnitTypeInfo(int(tile.PassengerUnit.UnitType))
+			label = healthUnitInfo.Abbreviation
+		}
+
+		setClass(dc, "unit "+getTribeClass(saveData, int(unit.Owner)))
+		drawUnitGlyph(dc, x, y, unitColor, unitInfo.Naval || tile.PassengerUnit != nil, label)
+		boxX, boxY, boxWidth, boxHeight := layout.getInnerBox(i, j)
+		drawHealthBar(dc, boxX, boxY, boxWidth, boxHeight, getUnitHealthFraction(unit, healthUnitInfo))
+		if unit.PromotionLevel > 0 {
+			drawVeteranMarker(dc, boxX, boxY, boxWidth, boxHeight)
+		}
+	}
+}
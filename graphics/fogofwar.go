@@ -0,0 +1,54 @@
+package graphics
+
+import (
+	polytopiamapmodel "github.com/samuelyuan/polytopiamapmodelgo"
+)
+
+const (
+	// Unexplored tiles have no terrain from the viewer's point of view
+	terrainCloud = 0
+)
+
+func isTileExplored(tileData polytopiamapmodel.TileData, playerId int) bool {
+	for i := 0; i < len(tileData.PlayerVisibility); i++ {
+		if tileData.PlayerVisibility[i] == playerId {
+			return true
+		}
+	}
+	return false
+}
+
+// Build a copy of the save data where tiles the player hasn't explored are replaced with clouds.
+// The original save data is not modified.
+func applyFogOfWar(saveData *polytopiamapmodel.PolytopiaSaveOutput, playerId int) *polytopiamapmodel.PolytopiaSaveOutput {
+	fogSaveData := *saveData
+	fogSaveData.TileData = make([][]polytopiamapmodel.TileData, saveData.MapHeight)
+	for i := 0; i < saveData.MapHeight; i++ {
+		fogSaveData.TileData[i] = make([]polytopiamapmodel.TileData, saveData.MapWidth)
+		for j := 0; j < saveData.MapWidth; j++ {
+			tileData := saveData.TileData[i][j]
+			if isTileExplored(tileData, playerId) {
+				fogSaveData.TileData[i][j] = tileData
+			} else {
+				fogSaveData.TileData[i][j] = polytopiamapmodel.TileData{
+					WorldCoordinates:   tileData.WorldCoordinates,
+					Terrain:            terrainCloud,
+					CapitalCoordinates: [2]int{-1, -1},
+					ResourceType:       -1,
+					ImprovementType:    -1,
+				}
+			}
+		}
+	}
+	return &fogSaveData
+}
+
+func drawCloud(dc canvas, layout mapLayout, i int, j int) {
+	imageX, imageY := layout.getImagePosition(i, j)
+
+	dc.DrawCircle(imageX+radius*0.3, imageY+radius*0.4, radius*0.2)
+	dc.DrawCircle(imageX+radius*0.55, imageY+radius*0.55, radius*0.22)
+	dc.DrawCircle(imageX+radius*0.7, imageY+radius*0.35, radius*0.18)
+	dc.SetRGB255(250, 250, 252) // cloud white
+	dc.Fill()
+}
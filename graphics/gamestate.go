@@ -0,0 +1,57 @@
+package graphics
+
+import (
+	"slices"
+
+	polytopiamapmodel "github.com/samuelyuan/polytopiamapmodelgo"
+)
+
+// Map at one point of the replay. A game state is never modified after the replay builds it,
+// so it can be drawn while the replay moves on and the save data it came from is left untouched.
+type GameState struct {
+	Turn int
+	// Player whose turn is shown, or zero if the state covers the whole round
+	PlayerId int
+	TileData [][]polytopiamapmodel.TileData
+	// What happened since the previous game state
+	Events  []ReplayEvent
+	Changed bool
+
+	saveData *polytopiamapmodel.PolytopiaSaveOutput
+	// Kills and losses are counted from the attacks replayed so far
+	playerData []polytopiamapmodel.PlayerData
+}
+
+// Copy of the save data with the tiles and kills of this game state, which can be passed to DrawMap
+func (gameState *GameState) SaveData() *polytopiamapmodel.PolytopiaSaveOutput {
+	saveData := *gameState.saveData
+	saveData.TileData = gameState.TileData
+	saveData.PlayerData = gameState.playerData
+	return &saveData
+}
+
+// Copy of the tiles that later actions can't modify
+func copyTileData(tileData [][]polytopiamapmodel.TileData) [][]polytopiamapmodel.TileData {
+	copiedTileData := make([][]polytopiamapmodel.TileData, len(tileData))
+	for i := 0; i < len(tileData); i++ {
+		copiedTileData[i] = make([]polytopiamapmodel.TileData, len(tileData[i]))
+		for j := 0; j < len(tileData[i]); j++ {
+			tile := tileData[i][j]
+			if tile.ImprovementData != nil {
+				improvementData := *tile.ImprovementData
+				tile.ImprovementData = &improvementData
+			}
+			if tile.Unit != nil {
+				unit := *tile.Unit
+				tile.Unit = &unit
+			}
+			if tile.PassengerUnit != nil {
+				passengerUnit := *tile.PassengerUnit
+				tile.PassengerUnit = &passengerUnit
+			}
+			tile.PlayerVisibility = slices.Clone(tile.PlayerVisibility)
+			copiedTileData[i][j] = tile
+		}
+	}
+	return copiedTileData
+}
@@ -0,0 +1,217 @@
+// Package gifwriter writes animated GIF files one frame at a time,
+// so that the frames don't need to be kept in memory until the end like gif.EncodeAll.
+package gifwriter
+
+import (
+	"bufio"
+	"compress/lzw"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+)
+
+const (
+	DisposalNone     = 0x01
+	DisposalPrevious = 0x03
+
+	// No transparent color in the frame
+	NoTransparentIndex = -1
+
+	// Longest delay that fits in the graphic control extension, in hundredths of a second
+	MaxDelay = 0xffff
+
+	extensionIntroducer     = 0x21
+	extensionGraphicControl = 0xf9
+	extensionApplication    = 0xff
+	imageSeparator          = 0x2c
+	trailer                 = 0x3b
+)
+
+type Encoder struct {
+	w *bufio.Writer
+	// Number of repeats after the first play, zero repeats forever and -1 plays once
+	loopCount int
+
+	width      int
+	height     int
+	frameCount int
+	err        error
+}
+
+func NewEncoder(w io.Writer, loopCount int) *Encoder {
+	return &Encoder{
+		w:         bufio.NewWriter(w),
+		loopCount: loopCount,
+	}
+}
+
+func (e *Encoder) write(b ...byte) {
+	if e.err != nil {
+		return
+	}
+	_, e.err = e.w.Write(b)
+}
+
+func (e *Encoder) writeUint16(v int) {
+	e.write(byte(v), byte(v>>8))
+}
+
+func (e *Encoder) writeHeader() {
+	e.write([]byte("GIF89a")...)
+	e.writeUint16(e.width)
+	e.writeUint16(e.height)
+	// No global color table, every frame has its own
+	e.write(0, 0, 0)
+
+	if e.loopCount >= 0 {
+		e.write(extensionIntroducer, extensionApplication, 11)
+		e.write([]byte("NETSCAPE2.0")...)
+		e.write(3, 1)
+		e.writeUint16(e.loopCount)
+		e.write(0)
+	}
+}
+
+// Number of bits needed for the palette, between 1 and 8
+func getPaletteBits(paletteSize int) int {
+	bits := 1
+	for 1<<bits < paletteSize {
+		bits++
+	}
+	return bits
+}
+
+// Write a frame shown for the delay in hundredths of a second, up to MaxDelay.
+// The first frame sets the canvas size. Later frames can be smaller and are placed at their bounds.
+func (e *Encoder) WriteFrame(img *image.Paletted, delay int, disposal byte, transparentIndex int) error {
+	if e.err != nil {
+		return e.err
+	}
+	if len(img.Palette) == 0 || len(img.Palette) > 256 {
+		return fmt.Errorf("gifwriter: palette has %v colors, must have between 1 and 256", len(img.Palette))
+	}
+
+	bounds := img.Bounds()
+	if e.frameCount == 0 {
+		if bounds.Min != (image.Point{}) {
+			return errors.New("gifwriter: first frame must start at the origin")
+		}
+		e.width = bounds.Dx()
+		e.height = bounds.Dy()
+		e.writeHeader()
+	} else if !bounds.In(image.Rect(0, 0, e.width, e.height)) {
+		return fmt.Errorf("gifwriter: frame %v with bounds %v is outside of the canvas", e.frameCount, bounds)
+	}
+
+	// Graphic control extension
+	flags := disposal << 2
+	transparentColor := byte(0)
+	if transparentIndex >= 0 {
+		flags |= 0x01
+		transparentColor = byte(transparentIndex)
+	}
+	e.write(extensionIntroducer, extensionGraphicControl, 4, flags)
+	e.writeUint16(min(max(delay, 0), MaxDelay))
+	e.write(transparentColor, 0)
+
+	// Image descriptor with a local color table
+	paletteBits := getPaletteBits(len(img.Palette))
+	e.write(imageSeparator)
+	e.writeUint16(bounds.Min.X)
+	e.writeUint16(bounds.Min.Y)
+	e.writeUint16(bounds.Dx())
+	e.writeUint16(bounds.Dy())
+	e.write(0x80 | byte(paletteBits-1))
+	for i := 0; i < 1<<paletteBits; i++ {
+		if i < len(img.Palette) {
+			r, g, b, _ := img.Palette[i].RGBA()
+			e.write(byte(r>>8), byte(g>>8), byte(b>>8))
+		} else {
+			e.write(0, 0, 0)
+		}
+	}
+
+	e.writeImageData(img, max(2, paletteBits))
+	e.frameCount++
+	return e.err
+}
+
+func (e *Encoder) writeImageData(img *image.Paletted, litWidth int) {
+	e.write(byte(litWidth))
+	if e.err != nil {
+		return
+	}
+
+	blocks := &blockWriter{w: e.w}
+	lzwWriter := lzw.NewWriter(blocks, lzw.LSB, litWidth)
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		start := img.PixOffset(bounds.Min.X, y)
+		if _, err := lzwWriter.Write(img.Pix[start : start+bounds.Dx()]); err != nil {
+			e.err = err
+			return
+		}
+	}
+	if err := lzwWriter.Close(); err != nil {
+		e.err = err
+		return
+	}
+	e.err = blocks.close()
+}
+
+func (e *Encoder) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+	if e.frameCount == 0 {
+		return errors.New("gifwriter: no frames to write")
+	}
+	e.write(trailer)
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+// Splits the compressed data into sub-blocks of at most 255 bytes, each prefixed by its length
+type blockWriter struct {
+	w   io.Writer
+	buf [256]byte
+	n   int
+}
+
+func (b *blockWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		count := copy(b.buf[1+b.n:], data)
+		b.n += count
+		written += count
+		data = data[count:]
+		if b.n == 255 {
+			if err := b.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (b *blockWriter) flush() error {
+	if b.n == 0 {
+		return nil
+	}
+	b.buf[0] = byte(b.n)
+	_, err := b.w.Write(b.buf[:1+b.n])
+	b.n = 0
+	return err
+}
+
+// Write any remaining data and the empty block that ends the image data
+func (b *blockWriter) close() error {
+	if err := b.flush(); err != nil {
+		return err
+	}
+	_, err := b.w.Write([]byte{0})
+	return err
+}
@@ -0,0 +1,164 @@
+package gifwriter
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+
+	"github.com/samuelyuan/PolytopiaMapImage/graphics/internal/imagetest"
+)
+
+var testPalette = color.Palette{
+	color.RGBA{0, 0, 0, 255},
+	color.RGBA{255, 0, 0, 255},
+	color.RGBA{0, 255, 0, 255},
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	fullPalette := make(color.Palette, 256)
+	for i := range fullPalette {
+		fullPalette[i] = color.RGBA{uint8(i), uint8(255 - i), uint8(i * 3), 255}
+	}
+	frames := []*image.Paletted{
+		imagetest.BuildPalettedFrame(image.Rect(0, 0, 64, 48), fullPalette, 0),
+		imagetest.BuildPalettedFrame(image.Rect(0, 0, 64, 48), testPalette, 1),
+		imagetest.BuildPalettedFrame(image.Rect(10, 5, 30, 25), testPalette, 2),
+	}
+	delays := []int{100, 20, 500}
+	disposals := []byte{DisposalNone, DisposalNone, DisposalPrevious}
+
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf, 2)
+	for i, frame := range frames {
+		if err := encoder.WriteFrame(frame, delays[i], disposals[i], NoTransparentIndex); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := gif.DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Config.Width != 64 || result.Config.Height != 48 {
+		t.Fatalf("canvas is %vx%v, expected 64x48", result.Config.Width, result.Config.Height)
+	}
+	if result.LoopCount != 2 {
+		t.Fatalf("loop count is %v, expected 2", result.LoopCount)
+	}
+	if len(result.Image) != len(frames) {
+		t.Fatalf("got %v frames, expected %v", len(result.Image), len(frames))
+	}
+	for i, frame := range frames {
+		resultFrame := result.Image[i]
+		if resultFrame.Bounds() != frame.Bounds() {
+			t.Fatalf("frame %v has bounds %v, expected %v", i, resultFrame.Bounds(), frame.Bounds())
+		}
+		if result.Delay[i] != delays[i] {
+			t.Fatalf("frame %v has delay %v, expected %v", i, result.Delay[i], delays[i])
+		}
+		if result.Disposal[i] != disposals[i] {
+			t.Fatalf("frame %v has disposal %v, expected %v", i, result.Disposal[i], disposals[i])
+		}
+		if !bytes.Equal(resultFrame.Pix, frame.Pix) {
+			t.Fatalf("frame %v has different pixels", i)
+		}
+		for colorIndex, paletteColor := range frame.Palette {
+			if resultFrame.Palette[colorIndex] != color.RGBAModel.Convert(paletteColor) {
+				t.Fatalf("frame %v has color %v at index %v, expected %v", i, resultFrame.Palette[colorIndex], colorIndex, paletteColor)
+			}
+		}
+	}
+}
+
+// Frame diff frames only store the changed area, with unchanged pixels set to the transparent index
+func TestEncodeTransparentFrame(t *testing.T) {
+	diffPalette := append(color.Palette{}, testPalette...)
+	diffPalette = append(diffPalette, color.RGBA{0, 0, 0, 0})
+	transparentIndex := len(testPalette)
+	diffFrame := imagetest.BuildPalettedFrame(image.Rect(2, 2, 6, 5), diffPalette, 0)
+	diffFrame.SetColorIndex(3, 3, uint8(transparentIndex))
+
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf, 0)
+	if err := encoder.WriteFrame(imagetest.BuildPalettedFrame(image.Rect(0, 0, 8, 8), testPalette, 0), 10, DisposalNone, NoTransparentIndex); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.WriteFrame(diffFrame, 10, DisposalNone, transparentIndex); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := gif.DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.LoopCount != 0 {
+		t.Fatalf("loop count is %v, expected 0", result.LoopCount)
+	}
+	resultFrame := result.Image[1]
+	if resultFrame.Bounds() != diffFrame.Bounds() {
+		t.Fatalf("frame has bounds %v, expected %v", resultFrame.Bounds(), diffFrame.Bounds())
+	}
+	if !bytes.Equal(resultFrame.Pix, diffFrame.Pix) {
+		t.Fatal("frame has different pixels")
+	}
+	// The decoder makes the transparent index fully transparent
+	if _, _, _, alpha := resultFrame.Palette[transparentIndex].RGBA(); alpha != 0 {
+		t.Fatalf("color at the transparent index has alpha %v, expected 0", alpha)
+	}
+	if _, _, _, alpha := result.Image[0].Palette[0].RGBA(); alpha == 0 {
+		t.Fatal("frame without a transparent index has a transparent color")
+	}
+}
+
+func TestEncodePlayOnce(t *testing.T) {
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf, -1)
+	if err := encoder.WriteFrame(imagetest.BuildPalettedFrame(image.Rect(0, 0, 2, 2), testPalette, 0), MaxDelay+1, DisposalNone, NoTransparentIndex); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := gif.DecodeAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.LoopCount != -1 {
+		t.Fatalf("loop count is %v, expected -1", result.LoopCount)
+	}
+	if result.Delay[0] != MaxDelay {
+		t.Fatalf("delay is %v, expected it to be clamped to %v", result.Delay[0], MaxDelay)
+	}
+}
+
+func TestEncodeInvalidFrames(t *testing.T) {
+	encoder := NewEncoder(&bytes.Buffer{}, 0)
+	if err := encoder.Close(); err == nil {
+		t.Fatal("expected an error for a GIF without frames")
+	}
+
+	encoder = NewEncoder(&bytes.Buffer{}, 0)
+	if err := encoder.WriteFrame(imagetest.BuildPalettedFrame(image.Rect(1, 1, 3, 3), testPalette, 0), 10, DisposalNone, NoTransparentIndex); err == nil {
+		t.Fatal("expected an error for a first frame that doesn't start at the origin")
+	}
+
+	encoder = NewEncoder(&bytes.Buffer{}, 0)
+	if err := encoder.WriteFrame(imagetest.BuildPalettedFrame(image.Rect(0, 0, 2, 2), testPalette, 0), 10, DisposalNone, NoTransparentIndex); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.WriteFrame(imagetest.BuildPalettedFrame(image.Rect(1, 1, 3, 3), testPalette, 0), 10, DisposalNone, NoTransparentIndex); err == nil {
+		t.Fatal("expected an error for a frame outside of the canvas")
+	}
+	if err := encoder.WriteFrame(image.NewPaletted(image.Rect(0, 0, 2, 2), nil), 10, DisposalNone, NoTransparentIndex); err == nil {
+		t.Fatal("expected an error for a frame without a palette")
+	}
+}
@@ -0,0 +1,60 @@
+// Package imagetest has the frames and pixel checks shared by the tests of the replay encoders.
+package imagetest
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// Every pixel has a different color and alpha, so pixels that are moved or mixed up are caught
+func BuildFrame(bounds image.Rectangle, seed int) *image.NRGBA {
+	img := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x*40 + seed), uint8(y*60 + seed), uint8(x*y + seed), uint8(255 - x*y)})
+		}
+	}
+	return img
+}
+
+// Pixels follow a pattern that doesn't compress well, so the image data spans several blocks
+func BuildPalettedFrame(bounds image.Rectangle, palette color.Palette, seed int) *image.Paletted {
+	img := image.NewPaletted(bounds, palette)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			img.SetColorIndex(x, y, uint8((x*7+y*13+x*y+seed)%len(palette)))
+		}
+	}
+	return img
+}
+
+// The result can start at a different point than the expected image, such as a frame decoded on its own
+func AssertSamePixels(t *testing.T, name string, expected image.Image, result image.Image) {
+	t.Helper()
+	bounds := expected.Bounds()
+	if result.Bounds().Dx() != bounds.Dx() || result.Bounds().Dy() != bounds.Dy() {
+		t.Fatalf("%v has size %v, expected %v", name, result.Bounds().Size(), bounds.Size())
+	}
+	offset := result.Bounds().Min.Sub(bounds.Min)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			expectedColor := color.NRGBAModel.Convert(expected.At(x, y))
+			resultColor := color.NRGBAModel.Convert(result.At(x+offset.X, y+offset.Y))
+			if expectedColor != resultColor {
+				t.Fatalf("%v pixel %v,%v is %v, expected %v", name, x, y, resultColor, expectedColor)
+			}
+		}
+	}
+}
+
+func CountColors(img image.Image) int {
+	colors := make(map[color.NRGBA]bool)
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			colors[color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)] = true
+		}
+	}
+	return len(colors)
+}
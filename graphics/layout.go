@@ -0,0 +1,125 @@
+package graphics
+
+import (
+	"fmt"
+	"sort"
+)
+
+type Projection string
+
+const (
+	// Axis aligned grid of square tiles
+	ProjectionSquare Projection = "square"
+	// Rotated grid of diamond tiles, matching the in-game view
+	ProjectionIsometric Projection = "iso"
+)
+
+var (
+	// Corners of the edge shared with each neighbor in NeighborOffset
+	neighborEdgeCorners = [4][2]int{{0, 1}, {3, 0}, {2, 3}, {1, 2}}
+)
+
+// Converts map rows and columns into image coordinates.
+// The map format is inverted, so row 0 is at the bottom of the image.
+type mapLayout struct {
+	projection Projection
+	mapHeight  int
+	mapWidth   int
+	paddingTop float64
+	drawOrder  [][2]int
+}
+
+func ParseProjection(value string) (Projection, error) {
+	switch Projection(value) {
+	case "", ProjectionSquare:
+		return ProjectionSquare, nil
+	case ProjectionIsometric:
+		return ProjectionIsometric, nil
+	}
+	return "", fmt.Errorf("invalid projection %v, must be iso or square", value)
+}
+
+func newMapLayout(projection Projection, mapHeight int, mapWidth int) mapLayout {
+	layout := mapLayout{
+		projection: projection,
+		mapHeight:  mapHeight,
+		mapWidth:   mapWidth,
+	}
+	if projection == ProjectionIsometric {
+		// Leave room for the mountains and city names on the top corner
+		layout.paddingTop = radius
+	}
+
+	// Draw tiles from back to front so that tall glyphs overlap the tiles behind them
+	layout.drawOrder = make([][2]int, 0, mapHeight*mapWidth)
+	for i := 0; i < mapHeight; i++ {
+		for j := 0; j < mapWidth; j++ {
+			layout.drawOrder = append(layout.drawOrder, [2]int{i, j})
+		}
+	}
+	sort.SliceStable(layout.drawOrder, func(a int, b int) bool {
+		_, centerYA := layout.getTileCenter(layout.drawOrder[a][0], layout.drawOrder[a][1])
+		_, centerYB := layout.getTileCenter(layout.drawOrder[b][0], layout.drawOrder[b][1])
+		return centerYA < centerYB
+	})
+	return layout
+}
+
+func (layout mapLayout) getImageSize() (float64, float64) {
+	if layout.projection == ProjectionIsometric {
+		diagonal := float64(layout.mapWidth + layout.mapHeight)
+		return diagonal * radius, diagonal*(radius/2) + layout.paddingTop
+	}
+	return float64(layout.mapWidth) * radius, float64(layout.mapHeight) * radius
+}
+
+func (layout mapLayout) getTileCenter(i int, j int) (float64, float64) {
+	row := float64(layout.mapHeight - 1 - i)
+	column := float64(j)
+	if layout.projection == ProjectionIsometric {
+		// Diamonds are twice as wide as they are tall
+		x := (column-row+float64(layout.mapHeight-1))*radius + radius
+		y := (column+row)*(radius/2) + (radius / 2) + layout.paddingTop
+		return x, y
+	}
+	return column*radius + (radius / 2), row*radius + (radius / 2)
+}
+
+// Top left corner of a square with the same size as a tile, centered on the tile.
+// Icons are drawn inside this square for every projection.
+func (layout mapLayout) getImagePosition(i int, j int) (float64, float64) {
+	centerX, centerY := layout.getTileCenter(i, j)
+	return centerX - (radius / 2), centerY - (radius / 2)
+}
+
+// Largest box centered on the tile that stays inside it, so that health bars, markers and the bases of glyphs
+// don't spill onto the tiles in front. Squares use the whole tile, diamonds a box half as tall as it is wide.
+// Returns the top left corner, width and height.
+func (layout mapLayout) getInnerBox(i int, j int) (float64, float64, float64, float64) {
+	if layout.projection == ProjectionIsometric {
+		centerX, centerY := layout.getTileCenter(i, j)
+		return centerX - (radius / 2), centerY - (radius / 4), radius, radius / 2
+	}
+	imageX, imageY := layout.getImagePosition(i, j)
+	return imageX, imageY, radius, radius
+}
+
+// Corners are in the order top left, top right, bottom right, bottom left for squares
+// and top, right, bottom, left for diamonds
+func (layout mapLayout) getTileCorners(i int, j int) [4][2]float64 {
+	centerX, centerY := layout.getTileCenter(i, j)
+	if layout.projection == ProjectionIsometric {
+		return [4][2]float64{
+			{centerX, centerY - (radius / 2)},
+			{centerX + radius, centerY},
+			{centerX, centerY + (radius / 2)},
+			{centerX - radius, centerY},
+		}
+	}
+	return [4][2]float64{
+		{centerX - (radius / 2), centerY - (radius / 2)},
+		{centerX + (radius / 2), centerY - (radius / 2)},
+		{centerX + (radius / 2), centerY + (radius / 2)},
+		{centerX - (radius / 2), centerY + (radius / 2)},
+	}
+}
@@ -0,0 +1,348 @@
+package graphics
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/samuelyuan/PolytopiaMapImage/graphics/apng"
+	"github.com/samuelyuan/PolytopiaMapImage/graphics/gifwriter"
+	"github.com/samuelyuan/PolytopiaMapImage/graphics/quantize"
+	"github.com/samuelyuan/PolytopiaMapImage/graphics/webp"
+	polytopiamapmodel "github.com/samuelyuan/polytopiamapmodelgo"
+)
+
+type ReplayFormat string
+
+const (
+	ReplayFormatGIF  ReplayFormat = "gif"
+	ReplayFormatAPNG ReplayFormat = "apng"
+	ReplayFormatWebP ReplayFormat = "webp"
+)
+
+// Use the format if given, otherwise pick the format from the output file extension
+func ParseReplayFormat(s string, outputFilename string) (ReplayFormat, error) {
+	if s == "" {
+		switch strings.ToLower(filepath.Ext(outputFilename)) {
+		case ".png", ".apng":
+			return ReplayFormatAPNG, nil
+		case ".webp":
+			return ReplayFormatWebP, nil
+		}
+		return ReplayFormatGIF, nil
+	}
+
+	switch ReplayFormat(strings.ToLower(s)) {
+	case ReplayFormatGIF:
+		return ReplayFormatGIF, nil
+	case ReplayFormatAPNG:
+		return ReplayFormatAPNG, nil
+	case ReplayFormatWebP:
+		return ReplayFormatWebP, nil
+	}
+	return "", fmt.Errorf("invalid replay format %v, must be gif, apng or webp", s)
+}
+
+// Writes the replay frames in order. The delay is in hundredths of a second.
+type frameEncoder interface {
+	WriteFrame(im image.Image, delay int) error
+	Close() error
+}
+
+// The palette is only used for GIF
+func newFrameEncoder(w io.Writer, options ReplayOptions, numFrames int, palette color.Palette) (frameEncoder, error) {
+	switch options.Format {
+	case "", ReplayFormatGIF:
+		return newGIFFrameEncoder(w, options.LoopCount, options.FrameDiff, palette), nil
+	case ReplayFormatAPNG:
+		return &apngFrameEncoder{
+			encoder:   apng.NewEncoder(w, numFrames, options.LoopCount),
+			frameDiff: options.FrameDiff,
+		}, nil
+	case ReplayFormatWebP:
+		if options.ReduceColors != 0 && (options.ReduceColors < webp.MinReduceColors || options.ReduceColors > webp.MaxReduceColors) {
+			return nil, fmt.Errorf("invalid number of colors %v, must be between %v and %v", options.ReduceColors, webp.MinReduceColors, webp.MaxReduceColors)
+		}
+		if options.Quality != 0 && (options.Quality < webp.MinQuality || options.Quality > webp.MaxQuality) {
+			return nil, fmt.Errorf("invalid quality %v, must be between %v and %v", options.Quality, webp.MinQuality, webp.MaxQuality)
+		}
+		if options.Lossy && options.ReduceColors != 0 {
+			return nil, fmt.Errorf("reducing the colors only works for lossless WebP")
+		}
+		webpOptions := webp.Options{
+			Lossy:        options.Lossy,
+			Quality:      options.Quality,
+			ReduceColors: options.ReduceColors,
+			LoopCount:    options.LoopCount,
+		}
+		return &webpFrameEncoder{
+			encoder:   webp.NewEncoder(w, webpOptions),
+			frameDiff: options.FrameDiff,
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported replay format %v", options.Format)
+}
+
+// Area where the current frame is different from the previous frame, or an empty rectangle if nothing changed
+func getChangedBounds(previous image.Image, current image.Image) image.Rectangle {
+	bounds := current.Bounds()
+	changed := image.Rectangle{}
+	isPixelChanged := func(x int, y int) bool {
+		return previous.At(x, y) != current.At(x, y)
+	}
+	if previousRGBA, ok := previous.(*image.RGBA); ok {
+		if currentRGBA, ok := current.(*image.RGBA); ok {
+			isPixelChanged = func(x int, y int) bool {
+				i := previousRGBA.PixOffset(x, y)
+				j := currentRGBA.PixOffset(x, y)
+				return previousRGBA.Pix[i] != currentRGBA.Pix[j] || previousRGBA.Pix[i+1] != currentRGBA.Pix[j+1] ||
+					previousRGBA.Pix[i+2] != currentRGBA.Pix[j+2] || previousRGBA.Pix[i+3] != currentRGBA.Pix[j+3]
+			}
+		}
+	} else if previousPaletted, ok := previous.(*image.Paletted); ok {
+		if currentPaletted, ok := current.(*image.Paletted); ok {
+			isPixelChanged = func(x int, y int) bool {
+				return previousPaletted.ColorIndexAt(x, y) != currentPaletted.ColorIndexAt(x, y)
+			}
+		}
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if isPixelChanged(x, y) {
+				changed = changed.Union(image.Rect(x, y, x+1, y+1))
+			}
+		}
+	}
+	return changed
+}
+
+// Area of the frame to store. The whole frame is stored unless frame diff is enabled.
+// Frames where nothing changed still store a single pixel to keep the delay.
+func getFrameDiffBounds(previous image.Image, current image.Image) image.Rectangle {
+	if previous == nil {
+		return current.Bounds()
+	}
+	changed := getChangedBounds(previous, current)
+	if changed.Empty() {
+		return image.Rect(0, 0, 1, 1)
+	}
+	return changed
+}
+
+func getSubImage(img image.Image, bounds image.Rectangle) image.Image {
+	if subImager, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return subImager.SubImage(bounds)
+	}
+	return img
+}
+
+// Every color the map, legend and chart of the save are drawn with, in the same order every time.
+// Only the blended edges of shapes fall between these colors.
+// If the colors don't fit in a GIF palette along with the transparent color, nil is returned so that the first frame is quantized instead.
+func buildReplayPalette(saveData *polytopiamapmodel.PolytopiaSaveOutput) color.Palette {
+	palette := make(color.Palette, 0)
+	paletteColors := make(map[color.RGBA]bool)
+	addColor := func(c color.RGBA) {
+		if !paletteColors[c] {
+			paletteColors[c] = true
+			palette = append(palette, c)
+		}
+	}
+
+	for _, c := range drawMapColors {
+		addColor(c)
+	}
+	addColor(unknownTerrainColor)
+	for _, terrain := range getSortedKeys(terrainTypeInfoMap) {
+		addColor(terrainTypeInfoMap[terrain].Color)
+	}
+	addColor(getImprovementTypeInfo(-1).Color)
+	for _, improvementType := range getSortedKeys(improvementTypeInfoMap) {
+		addColor(improvementTypeInfoMap[improvementType].Color)
+	}
+	for _, playerData := range saveData.PlayerData {
+		addColor(getPlayerColor(saveData, playerData.PlayerId))
+	}
+	for _, playerId := range getSortedKeys(saveData.OwnerTribeMap) {
+		addColor(getPlayerColor(saveData, playerId))
+	}
+
+	if len(palette) >= 256 {
+		return nil
+	}
+	return palette
+}
+
+func getSortedKeys[V any](m map[int]V) []int {
+	keys := make([]int, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// Frames are written as they are drawn instead of being kept until the end
+type gifFrameEncoder struct {
+	encoder   *gifwriter.Encoder
+	quantizer quantize.MedianCutQuantizer
+	// Quantized from the first frame if nil
+	mapPalette color.Palette
+	frameDiff  bool
+	// Only kept for frame diff
+	previousFrame *image.Paletted
+}
+
+// The GIF loop count is the number of repeats after the first play, or -1 to play once
+func getGIFLoopCount(playCount int) int {
+	if playCount <= 0 {
+		return 0
+	}
+	if playCount == 1 {
+		return -1
+	}
+	return playCount - 1
+}
+
+func newGIFFrameEncoder(w io.Writer, playCount int, frameDiff bool, palette color.Palette) *gifFrameEncoder {
+	return &gifFrameEncoder{
+		encoder:    gifwriter.NewEncoder(w, getGIFLoopCount(playCount)),
+		quantizer:  quantize.MedianCutQuantizer{NumColor: 256},
+		mapPalette: palette,
+		frameDiff:  frameDiff,
+	}
+}
+
+// Only store the changed area, with unchanged pixels inside it made transparent
+func (e *gifFrameEncoder) buildDiffFrame(palettedImage *image.Paletted) (*image.Paletted, int) {
+	bounds := getFrameDiffBounds(e.previousFrame, palettedImage)
+	if len(palettedImage.Palette) >= 256 {
+		// No room for a transparent color, so the changed area is stored as it is
+		return palettedImage.SubImage(bounds).(*image.Paletted), gifwriter.NoTransparentIndex
+	}
+
+	transparentIndex := len(palettedImage.Palette)
+	diffPalette := append(color.Palette{}, palettedImage.Palette...)
+	diffPalette = append(diffPalette, color.RGBA{0, 0, 0, 0})
+	diffImage := image.NewPaletted(bounds, diffPalette)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			colorIndex := palettedImage.ColorIndexAt(x, y)
+			if colorIndex == e.previousFrame.ColorIndexAt(x, y) {
+				colorIndex = uint8(transparentIndex)
+			}
+			diffImage.SetColorIndex(x, y, colorIndex)
+		}
+	}
+	return diffImage, transparentIndex
+}
+
+func (e *gifFrameEncoder) WriteFrame(mapImage image.Image, delay int) error {
+	bounds := mapImage.Bounds()
+	palettedImage := image.NewPaletted(bounds, nil)
+	if e.mapPalette == nil {
+		e.quantizer.Quantize(palettedImage, bounds, mapImage, image.ZP)
+		e.mapPalette = palettedImage.Palette
+	} else {
+		e.quantizer.UseExistingPalette(palettedImage, bounds, mapImage, image.ZP, e.mapPalette)
+	}
+
+	frame := palettedImage
+	transparentIndex := gifwriter.NoTransparentIndex
+	if e.frameDiff && e.previousFrame != nil {
+		frame, transparentIndex = e.buildDiffFrame(palettedImage)
+	}
+	if e.frameDiff {
+		e.previousFrame = palettedImage
+	}
+
+	if err := e.encoder.WriteFrame(frame, delay, gifwriter.DisposalNone, transparentIndex); err != nil {
+		return fmt.Errorf("error while saving GIF: %w", err)
+	}
+	return nil
+}
+
+func (e *gifFrameEncoder) Close() error {
+	if err := e.encoder.Close(); err != nil {
+		return fmt.Errorf("error while saving GIF: %w", err)
+	}
+	return nil
+}
+
+// Full color and lossless, so there is no quantization
+type apngFrameEncoder struct {
+	encoder   *apng.Encoder
+	frameDiff bool
+	// Only kept for frame diff
+	previousFrame image.Image
+}
+
+// APNG delays are a fraction with 16 bit parts, so delays too long for hundredths of a second
+// are stored in whole seconds instead of wrapping around
+func getAPNGDelay(delay int) (uint16, uint16) {
+	if delay <= math.MaxUint16 {
+		return uint16(delay), 100
+	}
+	return uint16(min((delay+50)/100, math.MaxUint16)), 1
+}
+
+func (e *apngFrameEncoder) WriteFrame(mapImage image.Image, delay int) error {
+	frame := mapImage
+	if e.frameDiff {
+		frame = getSubImage(mapImage, getFrameDiffBounds(e.previousFrame, mapImage))
+		e.previousFrame = mapImage
+	}
+
+	delayNum, delayDen := getAPNGDelay(delay)
+	if err := e.encoder.WriteFrame(frame, delayNum, delayDen); err != nil {
+		return fmt.Errorf("error while saving APNG: %w", err)
+	}
+	return nil
+}
+
+func (e *apngFrameEncoder) Close() error {
+	if err := e.encoder.Close(); err != nil {
+		return fmt.Errorf("error while saving APNG: %w", err)
+	}
+	return nil
+}
+
+// Much smaller than GIF for long replays
+type webpFrameEncoder struct {
+	encoder   *webp.Encoder
+	frameDiff bool
+	// Only kept for frame diff
+	previousFrame image.Image
+}
+
+func (e *webpFrameEncoder) WriteFrame(mapImage image.Image, delay int) error {
+	frame := mapImage
+	if e.frameDiff {
+		// WebP frames must start at even coordinates
+		bounds := getFrameDiffBounds(e.previousFrame, mapImage)
+		bounds.Min = image.Pt(bounds.Min.X&^1, bounds.Min.Y&^1)
+		frame = getSubImage(mapImage, bounds)
+		e.previousFrame = mapImage
+	}
+
+	// WebP delays are in milliseconds
+	if err := e.encoder.WriteFrame(frame, delay*10); err != nil {
+		return fmt.Errorf("error while saving WebP: %w", err)
+	}
+	return nil
+}
+
+func (e *webpFrameEncoder) Close() error {
+	if err := e.encoder.Close(); err != nil {
+		return fmt.Errorf("error while saving WebP: %w", err)
+	}
+	return nil
+}
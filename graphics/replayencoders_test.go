@@ -0,0 +1,143 @@
+package graphics
+
+import (
+	"image/color"
+	"testing"
+
+	"github.com/fogleman/gg"
+	polytopiamapmodel "github.com/samuelyuan/polytopiamapmodelgo"
+)
+
+// Keeps every color set while drawing
+type colorRecordingCanvas struct {
+	canvas
+	colors map[color.RGBA]bool
+}
+
+func (dc *colorRecordingCanvas) SetRGB255(r int, g int, b int) {
+	dc.colors[color.RGBA{uint8(r), uint8(g), uint8(b), 255}] = true
+	dc.canvas.SetRGB255(r, g, b)
+}
+
+// Every terrain, improvement, resource and unit type is on the map once, along with types that aren't known.
+// Player 3 has an override color, player 4 has an unknown tribe and player 5 has no tribe.
+func buildPaletteTestSave() *polytopiamapmodel.PolytopiaSaveOutput {
+	terrainTypes := append(getSortedKeys(terrainTypeInfoMap), 99)
+	improvementTypes := append(getSortedKeys(improvementTypeInfoMap), improvementCity, 99)
+	resourceTypes := []int{ResourceGame, ResourceFruit, ResourceFish, ResourceCrop, ResourceMetal, ResourceWhale, ResourceStarfish, ResourceSpores, 99}
+	unitTypes := append(getSortedKeys(unitTypeInfoMap), 99)
+
+	mapSize := 8
+	tileCount := max(len(terrainTypes), len(improvementTypes), len(resourceTypes), len(unitTypes))
+	for mapSize*mapSize < tileCount {
+		mapSize++
+	}
+
+	tileData := make([][]polytopiamapmodel.TileData, mapSize)
+	for i := 0; i < mapSize; i++ {
+		tileData[i] = make([]polytopiamapmodel.TileData, mapSize)
+		for j := 0; j < mapSize; j++ {
+			k := i*mapSize + j
+			tile := polytopiamapmodel.TileData{
+				WorldCoordinates:   [2]int{j, i},
+				Terrain:            terrainTypes[k%len(terrainTypes)],
+				Owner:              k % 6,
+				CapitalCoordinates: [2]int{-1, -1},
+				ResourceType:       -1,
+				ImprovementType:    -1,
+				HasRoad:            k%2 == 0,
+				HasWaterRoute:      k%3 == 0,
+			}
+			// Odd tiles are hidden from the viewer
+			if k%2 == 0 {
+				tile.PlayerVisibility = []int{1}
+			}
+			if k < len(improvementTypes) {
+				tile.ImprovementExists = true
+				tile.ImprovementType = improvementTypes[k]
+				tile.ImprovementData = &polytopiamapmodel.ImprovementData{Level: 2, CityName: "City"}
+			}
+			if k < len(resourceTypes) {
+				tile.ResourceExists = true
+				tile.ResourceType = resourceTypes[k]
+			}
+			if k < len(unitTypes) {
+				tile.Unit = &polytopiamapmodel.UnitData{Owner: uint8(k % 6), UnitType: uint16(unitTypes[k]), Health: 50, PromotionLevel: uint16(k % 2)}
+				if k%4 == 0 {
+					tile.PassengerUnit = &polytopiamapmodel.UnitData{Owner: uint8(k % 6), UnitType: 2, Health: 100}
+				}
+			}
+			tileData[i][j] = tile
+		}
+	}
+
+	playerData := make([]polytopiamapmodel.PlayerData, 0)
+	for playerId := 1; playerId <= 5; playerId++ {
+		overrideColor := []int{0, 0, 0, 255}
+		if playerId == 3 {
+			overrideColor = []int{10, 20, 30, 0}
+		}
+		playerData = append(playerData, polytopiamapmodel.PlayerData{PlayerId: playerId, Tribe: playerId + 10, OverrideColor: overrideColor})
+	}
+	return &polytopiamapmodel.PolytopiaSaveOutput{
+		MapHeight:     mapSize,
+		MapWidth:      mapSize,
+		MaxTurn:       3,
+		TileData:      tileData,
+		OwnerTribeMap: map[int]int{1: 2, 2: 13, 3: 7, 4: 99},
+		PlayerData:    playerData,
+	}
+}
+
+func TestReplayPaletteHasEveryDrawnColor(t *testing.T) {
+	saveData := buildPaletteTestSave()
+	recorder := &colorRecordingCanvas{colors: make(map[color.RGBA]bool)}
+	newCanvas := func(width int, height int) canvas {
+		recorder.canvas = gg.NewContext(width, height)
+		return recorder
+	}
+
+	optionsList := []RenderOptions{
+		{Legend: true, Caption: "Turn 1"},
+		{Legend: true, HideScore: true, Projection: ProjectionIsometric},
+		{Viewer: 1},
+	}
+	for _, options := range optionsList {
+		if err := drawMapOnCanvas(saveData, options, newCanvas); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	territoryStats := []TerritoryStats{
+		{Turn: 1, Tiles: map[int]int{1: 3, 2: 2}, Cities: map[int]int{1: 1}},
+		{Turn: 2, Tiles: map[int]int{1: 4, 2: 5, 5: 1}, Cities: map[int]int{1: 1, 2: 1}},
+	}
+	for _, stacked := range []bool{true, false} {
+		drawTerritoryChart(newCanvas(400, 200), newChartLayout(saveData, territoryStats, 400, 200, stacked), territoryStats, 2)
+	}
+
+	palette := buildReplayPalette(saveData)
+	if palette == nil {
+		t.Fatal("colors don't fit in a GIF palette")
+	}
+	for c := range recorder.colors {
+		if palette.Convert(c) != c {
+			t.Fatalf("drawn color %v is missing from the replay palette", c)
+		}
+	}
+}
+
+func TestReplayPaletteIsStable(t *testing.T) {
+	palette := buildReplayPalette(buildPaletteTestSave())
+	for i := 0; i < 10; i++ {
+		otherPalette := buildReplayPalette(buildPaletteTestSave())
+		if len(otherPalette) != len(palette) {
+			t.Fatalf("palette has %v colors, expected %v", len(otherPalette), len(palette))
+		}
+		for j := range palette {
+			if otherPalette[j] != palette[j] {
+				t.Fatalf("palette color %v is %v, expected %v", j, otherPalette[j], palette[j])
+			}
+		}
+	}
+}
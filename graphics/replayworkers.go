@@ -0,0 +1,113 @@
+package graphics
+
+import (
+	"fmt"
+	"image"
+	"runtime"
+	"sync"
+)
+
+// Frames that are waiting to be drawn or written for each worker.
+// This bounds the memory used by tile snapshots and finished images.
+const framesInFlightPerWorker = 2
+
+type frameJob struct {
+	frameIndex int
+	gameState  *GameState
+	caption    string
+}
+
+type frameResult struct {
+	frameIndex int
+	mapImage   image.Image
+	gameState  *GameState
+	err        error
+}
+
+// Draw the frames on a pool of workers and pass each image to writeFrame in frame order.
+// The actions are still applied in order, and each worker draws the game state for its frame with drawFrame.
+func (state *replayState) drawFrames(
+	frames []replayFrame,
+	drawFrame frameDrawer,
+	writeFrame func(frameIndex int, mapImage image.Image, gameState *GameState) error,
+) error {
+	numWorkers := runtime.GOMAXPROCS(0)
+	jobs := make(chan frameJob)
+	results := make(chan frameResult, numWorkers)
+	// Taken before a frame is queued and given back once it is written
+	framesInFlight := make(chan struct{}, numWorkers*framesInFlightPerWorker)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(jobs)
+		// City events since the start of the turn, so that every frame of a turn lists them
+		turnEvents := make([]ReplayEvent, 0)
+		for frameIndex, frame := range frames {
+			select {
+			case framesInFlight <- struct{}{}:
+			case <-done:
+				return
+			}
+
+			gameState := state.advanceToFrame(frame)
+			if frameIndex > 0 && frames[frameIndex-1].Turn != frame.Turn {
+				turnEvents = make([]ReplayEvent, 0)
+			}
+			turnEvents = append(turnEvents, gameState.Events...)
+			jobs <- frameJob{
+				frameIndex: frameIndex,
+				gameState:  gameState,
+				caption:    getReplayCaption(state.saveData, frame, turnEvents),
+			}
+		}
+	}()
+
+	var workers sync.WaitGroup
+	for i := 0; i < numWorkers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				mapImage, err := drawFrame(job.gameState, job.caption)
+				if err != nil {
+					err = fmt.Errorf("failed to draw frame for turn %v: %w", frames[job.frameIndex].Turn, err)
+				}
+				results <- frameResult{frameIndex: job.frameIndex, mapImage: mapImage, gameState: job.gameState, err: err}
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	// Frames can finish out of order, so they wait here until the frames before them are written
+	var firstErr error
+	pendingResults := make(map[int]frameResult)
+	nextFrameIndex := 0
+	for result := range results {
+		pendingResults[result.frameIndex] = result
+		for {
+			nextResult, ok := pendingResults[nextFrameIndex]
+			if !ok {
+				break
+			}
+			delete(pendingResults, nextFrameIndex)
+			nextFrameIndex++
+			<-framesInFlight
+
+			if firstErr != nil {
+				continue
+			}
+			firstErr = nextResult.err
+			if firstErr == nil {
+				firstErr = writeFrame(nextResult.frameIndex, nextResult.mapImage, nextResult.gameState)
+			}
+			if firstErr != nil {
+				// Stop queueing frames, but keep reading results until the workers finish
+				close(done)
+			}
+		}
+	}
+	return firstErr
+}
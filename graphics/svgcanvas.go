@@ -0,0 +1,259 @@
+package graphics
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"image/color"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/fogleman/gg"
+	"golang.org/x/image/font"
+)
+
+// Drawing state saved by Push and restored by Pop
+type svgState struct {
+	matrix     gg.Matrix
+	color      color.RGBA
+	lineWidth  float64
+	dashes     []float64
+	fontFace   font.Face
+	fontHeight float64
+	fontSize   float64
+}
+
+// Canvas that writes every filled or stroked path as an SVG element instead of rasterizing it.
+// Like gg, points are transformed by the current matrix, while line widths and dashes are in pixels.
+type svgCanvas struct {
+	svgState
+	width  int
+	height int
+	stack  []svgState
+	class  string
+
+	path bytes.Buffer
+	// Whether a subpath has been started that LineTo continues from
+	hasCurrentPoint bool
+	body            bytes.Buffer
+}
+
+func newSVGCanvas(width int, height int) *svgCanvas {
+	return &svgCanvas{
+		svgState: svgState{
+			matrix:    gg.Identity(),
+			color:     color.RGBA{0, 0, 0, 255},
+			lineWidth: 1,
+		},
+		width:  width,
+		height: height,
+	}
+}
+
+func (dc *svgCanvas) MoveTo(x float64, y float64) {
+	x, y = dc.matrix.TransformPoint(x, y)
+	fmt.Fprintf(&dc.path, "M%.2f %.2f", x, y)
+	dc.hasCurrentPoint = true
+}
+
+func (dc *svgCanvas) LineTo(x float64, y float64) {
+	if !dc.hasCurrentPoint {
+		dc.MoveTo(x, y)
+		return
+	}
+	x, y = dc.matrix.TransformPoint(x, y)
+	fmt.Fprintf(&dc.path, "L%.2f %.2f", x, y)
+}
+
+func (dc *svgCanvas) ClosePath() {
+	if dc.hasCurrentPoint {
+		dc.path.WriteString("Z")
+	}
+}
+
+// The next LineTo starts a new subpath, as in gg
+func (dc *svgCanvas) newSubPath() {
+	dc.hasCurrentPoint = false
+}
+
+func (dc *svgCanvas) DrawLine(x1 float64, y1 float64, x2 float64, y2 float64) {
+	dc.MoveTo(x1, y1)
+	dc.LineTo(x2, y2)
+}
+
+func (dc *svgCanvas) DrawRectangle(x float64, y float64, w float64, h float64) {
+	dc.newSubPath()
+	dc.MoveTo(x, y)
+	dc.LineTo(x+w, y)
+	dc.LineTo(x+w, y+h)
+	dc.LineTo(x, y+h)
+	dc.ClosePath()
+}
+
+func (dc *svgCanvas) DrawCircle(x float64, y float64, r float64) {
+	dc.DrawEllipse(x, y, r, r)
+}
+
+// Drawn as two arcs. The map is only scaled and translated, so the ellipse stays axis aligned.
+func (dc *svgCanvas) DrawEllipse(x float64, y float64, rx float64, ry float64) {
+	centerX, centerY := dc.matrix.TransformPoint(x, y)
+	scaledRx, scaledRy := dc.matrix.TransformVector(rx, ry)
+	scaledRx, scaledRy = math.Abs(scaledRx), math.Abs(scaledRy)
+	fmt.Fprintf(&dc.path, "M%.2f %.2fA%.2f %.2f 0 1 0 %.2f %.2fA%.2f %.2f 0 1 0 %.2f %.2fZ",
+		centerX+scaledRx, centerY,
+		scaledRx, scaledRy, centerX-scaledRx, centerY,
+		scaledRx, scaledRy, centerX+scaledRx, centerY)
+	dc.hasCurrentPoint = false
+}
+
+// Same corners as gg.Context.DrawRegularPolygon
+func (dc *svgCanvas) DrawRegularPolygon(n int, x float64, y float64, r float64, rotation float64) {
+	angle := 2 * math.Pi / float64(n)
+	rotation -= math.Pi / 2
+	if n%2 == 0 {
+		rotation += angle / 2
+	}
+	dc.newSubPath()
+	for i := 0; i < n; i++ {
+		a := rotation + angle*float64(i)
+		dc.LineTo(x+r*math.Cos(a), y+r*math.Sin(a))
+	}
+	dc.ClosePath()
+}
+
+func (dc *svgCanvas) SetRGB255(r int, g int, b int) {
+	dc.color = color.RGBA{uint8(r), uint8(g), uint8(b), 255}
+}
+
+func (dc *svgCanvas) SetLineWidth(lineWidth float64) {
+	dc.lineWidth = lineWidth
+}
+
+func (dc *svgCanvas) SetDash(dashes ...float64) {
+	dc.dashes = dashes
+}
+
+func (dc *svgCanvas) SetClass(class string) {
+	dc.class = class
+}
+
+func (dc *svgCanvas) getClassAttribute() string {
+	if dc.class == "" {
+		return ""
+	}
+	return fmt.Sprintf(" class=\"%v\"", html.EscapeString(dc.class))
+}
+
+func (dc *svgCanvas) clearPath() {
+	dc.path.Reset()
+	dc.hasCurrentPoint = false
+}
+
+func (dc *svgCanvas) FillPreserve() {
+	if dc.path.Len() == 0 {
+		return
+	}
+	fmt.Fprintf(&dc.body, "<path%v d=\"%v\" fill=\"%v\"/>\n", dc.getClassAttribute(), dc.path.String(), getSVGColor(dc.color))
+}
+
+func (dc *svgCanvas) Fill() {
+	dc.FillPreserve()
+	dc.clearPath()
+}
+
+func (dc *svgCanvas) Stroke() {
+	if dc.path.Len() == 0 {
+		return
+	}
+	dashArray := ""
+	if len(dc.dashes) > 0 {
+		dashes := make([]string, len(dc.dashes))
+		for i, dash := range dc.dashes {
+			dashes[i] = fmt.Sprintf("%.2f", dash)
+		}
+		dashArray = fmt.Sprintf(" stroke-dasharray=\"%v\"", strings.Join(dashes, " "))
+	}
+	fmt.Fprintf(&dc.body, "<path%v d=\"%v\" fill=\"none\" stroke=\"%v\" stroke-width=\"%.2f\"%v/>\n",
+		dc.getClassAttribute(), dc.path.String(), getSVGColor(dc.color), dc.lineWidth, dashArray)
+	dc.clearPath()
+}
+
+func (dc *svgCanvas) SetFontFace(fontFace font.Face) {
+	dc.fontFace = fontFace
+	dc.fontHeight = float64(fontFace.Metrics().Height) / 64
+}
+
+func (dc *svgCanvas) SetFontSize(size float64) {
+	dc.fontSize = size
+}
+
+func (dc *svgCanvas) FontHeight() float64 {
+	return dc.fontHeight
+}
+
+// Measured with the font used for raster images, so boxes around text have the same size
+func (dc *svgCanvas) MeasureString(s string) (float64, float64) {
+	if dc.fontFace == nil {
+		return 0, dc.fontHeight
+	}
+	return float64(font.MeasureString(dc.fontFace, s) >> 6), dc.fontHeight
+}
+
+// The viewer's font can be wider or narrower than the measured width,
+// so the text is anchored by the viewer instead of moving the starting point
+func (dc *svgCanvas) DrawStringAnchored(s string, x float64, y float64, ax float64, ay float64) {
+	textAnchor := "start"
+	if ax >= 1 {
+		textAnchor = "end"
+	} else if ax > 0 {
+		textAnchor = "middle"
+	}
+	x, y = dc.matrix.TransformPoint(x, y)
+	y += ay * dc.fontHeight
+	fmt.Fprintf(&dc.body, "<text%v x=\"%.2f\" y=\"%.2f\" fill=\"%v\" font-size=\"%.2f\" text-anchor=\"%v\">%v</text>\n",
+		dc.getClassAttribute(), x, y, getSVGColor(dc.color), dc.fontSize, textAnchor, html.EscapeString(s))
+}
+
+func (dc *svgCanvas) Push() {
+	dc.stack = append(dc.stack, dc.svgState)
+}
+
+func (dc *svgCanvas) Pop() {
+	dc.svgState = dc.stack[len(dc.stack)-1]
+	dc.stack = dc.stack[:len(dc.stack)-1]
+}
+
+func (dc *svgCanvas) Identity() {
+	dc.matrix = gg.Identity()
+}
+
+func (dc *svgCanvas) Scale(x float64, y float64) {
+	dc.matrix = dc.matrix.Scale(x, y)
+}
+
+func (dc *svgCanvas) Translate(x float64, y float64) {
+	dc.matrix = dc.matrix.Translate(x, y)
+}
+
+func (dc *svgCanvas) TransformPoint(x float64, y float64) (float64, float64) {
+	return dc.matrix.TransformPoint(x, y)
+}
+
+func (dc *svgCanvas) Height() int {
+	return dc.height
+}
+
+func getSVGColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func (dc *svgCanvas) Encode(w io.Writer) error {
+	var svg bytes.Buffer
+	fmt.Fprintf(&svg, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%v\" height=\"%v\" viewBox=\"0 0 %v %v\" font-family=\"Go, sans-serif\">\n",
+		dc.width, dc.height, dc.width, dc.height)
+	svg.Write(dc.body.Bytes())
+	svg.WriteString("</svg>\n")
+	_, err := svg.WriteTo(w)
+	return err
+}
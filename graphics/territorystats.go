@@ -0,0 +1,66 @@
+package graphics
+
+import (
+	"github.com/samuelyuan/PolytopiaMapImage/actions"
+	polytopiamapmodel "github.com/samuelyuan/polytopiamapmodelgo"
+)
+
+// Tiles and cities owned by each player id at the end of a turn
+type TerritoryStats struct {
+	Turn   int         `json:"turn"`
+	Tiles  map[int]int `json:"tiles"`
+	Cities map[int]int `json:"cities"`
+}
+
+func countTerritory(turn int, tileData [][]polytopiamapmodel.TileData) TerritoryStats {
+	stats := TerritoryStats{
+		Turn:   turn,
+		Tiles:  make(map[int]int),
+		Cities: make(map[int]int),
+	}
+	for i := 0; i < len(tileData); i++ {
+		for j := 0; j < len(tileData[i]); j++ {
+			tile := tileData[i][j]
+			if tile.Owner <= 0 {
+				continue
+			}
+			stats.Tiles[tile.Owner]++
+			if tile.ImprovementType == improvementCity && tile.ImprovementData != nil {
+				stats.Cities[tile.Owner]++
+			}
+		}
+	}
+	return stats
+}
+
+// Replay the actions and count the territory of every player at the end of each turn.
+// If replayActions is nil, only the city captures stored in the save data are replayed.
+func BuildTerritoryStats(saveData *polytopiamapmodel.PolytopiaSaveOutput, replayActions []actions.Action) ([]TerritoryStats, error) {
+	state, frames, err := newReplay(saveData, replayActions, ReplayOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return state.buildTerritoryStats(frames), nil
+}
+
+// Frames must be one per round, starting from the current action of the replay
+func (state *replayState) buildTerritoryStats(frames []replayFrame) []TerritoryStats {
+	territoryStats := make([]TerritoryStats, 0, len(frames))
+	for _, frame := range frames {
+		state.applyActions(frame.ActionEnd)
+		territoryStats = append(territoryStats, countTerritory(frame.Turn, state.tileData))
+	}
+	return territoryStats
+}
+
+// Stats of the turns before the game state, followed by the game state itself,
+// so that a chart drawn during the replay ends at the map being shown
+func getTerritoryStatsUntil(territoryStats []TerritoryStats, gameState *GameState) []TerritoryStats {
+	statsUntil := make([]TerritoryStats, 0, gameState.Turn)
+	for _, stats := range territoryStats {
+		if stats.Turn < gameState.Turn {
+			statsUntil = append(statsUntil, stats)
+		}
+	}
+	return append(statsUntil, countTerritory(gameState.Turn, gameState.TileData))
+}
@@ -0,0 +1,67 @@
+package webp
+
+// Arithmetic coder for the partitions of a VP8 frame, as specified in section 7.3 of RFC 6386.
+// The probability of each bit is the chance out of 256 that it's zero.
+type boolEncoder struct {
+	buf []byte
+	// Between 128 and 255 after every bit
+	rng    uint32
+	bottom uint32
+	// Bits left before the next byte is written
+	bitCount int
+}
+
+func newBoolEncoder() *boolEncoder {
+	return &boolEncoder{
+		rng:      255,
+		bitCount: 24,
+	}
+}
+
+// Carry into the bytes already written
+func (e *boolEncoder) addOne() {
+	i := len(e.buf) - 1
+	for i >= 0 && e.buf[i] == 255 {
+		e.buf[i] = 0
+		i--
+	}
+	e.buf[i]++
+}
+
+func (e *boolEncoder) putBit(bit bool, prob uint8) {
+	split := 1 + ((e.rng-1)*uint32(prob))>>8
+	if bit {
+		e.bottom += split
+		e.rng -= split
+	} else {
+		e.rng = split
+	}
+	for e.rng < 128 {
+		e.rng <<= 1
+		if e.bottom&(1<<31) != 0 {
+			e.addOne()
+		}
+		e.bottom <<= 1
+		e.bitCount--
+		if e.bitCount == 0 {
+			e.buf = append(e.buf, byte(e.bottom>>24))
+			e.bottom &= (1 << 24) - 1
+			e.bitCount = 8
+		}
+	}
+}
+
+// Write an unsigned value with the most significant bit first
+func (e *boolEncoder) putLiteral(value int, numBits int) {
+	for i := numBits - 1; i >= 0; i-- {
+		e.putBit((value>>i)&1 != 0, 128)
+	}
+}
+
+// Pad the partition so decoders that read ahead don't run past the end
+func (e *boolEncoder) finish() []byte {
+	for i := 0; i < 32; i++ {
+		e.putBit(false, 128)
+	}
+	return e.buf
+}
@@ -0,0 +1,799 @@
+package webp
+
+import (
+	"fmt"
+	"image"
+	"math"
+)
+
+// Lossy frames are stored as VP8 key frames, as specified in RFC 6386.
+// Every macroblock is predicted as a whole, with one mode for the 16x16 luma block and one for both 8x8 chroma blocks.
+// The loop filter is left off, since the quantizer is the only setting.
+
+const (
+	MinQuality     = 1
+	MaxQuality     = 100
+	DefaultQuality = 75
+
+	// Width and height are stored in 14 bits
+	maxVP8Size = 1<<14 - 1
+	// Size of the first partition is stored in 19 bits
+	maxFirstPartitionSize = 1<<19 - 1
+	// Largest coefficient that can be written, with the 11 extra bits of DCT_CAT6
+	maxCoeffLevel = 2048
+)
+
+// Intra prediction modes, the same for 16x16 luma and 8x8 chroma blocks
+const (
+	predDC = iota
+	predTM
+	predVE
+	predHE
+	numPredModes
+)
+
+// Rounding bias out of 256 for the DC and AC coefficients.
+// It's below a half, so coefficients just over half a step become zero and cost fewer bits.
+var quantBias = [2]int32{96, 110}
+
+// Step sizes of the DC and AC coefficients of each kind of block, as the decoder works them out from the quantizer index
+type vp8Quantizer struct {
+	y1 [2]int32
+	y2 [2]int32
+	uv [2]int32
+}
+
+func newVP8Quantizer(qIndex int) vp8Quantizer {
+	return vp8Quantizer{
+		y1: [2]int32{int32(dcQuantTable[qIndex]), int32(acQuantTable[qIndex])},
+		y2: [2]int32{int32(dcQuantTable[qIndex]) * 2, max(int32(acQuantTable[qIndex])*155/100, 8)},
+		uv: [2]int32{int32(dcQuantTable[min(qIndex, 117)]), int32(acQuantTable[qIndex])},
+	}
+}
+
+// Quantizer index from 0 to 127 for the quality, on the same curve as libwebp so a quality gives a similar file size
+func getQuantizerIndex(quality int) int {
+	c := float64(min(max(quality, MinQuality), MaxQuality)) / 100
+	linear := 2*c - 1
+	if c < 0.75 {
+		linear = c * 2 / 3
+	}
+	return min(max(int(127*(1-math.Cbrt(linear))), 0), 127)
+}
+
+type vp8Macroblock struct {
+	lumaMode   uint8
+	chromaMode uint8
+	// Quantized coefficients of each 4x4 block in raster order.
+	// The DC coefficients of the luma blocks are left out and stored in the y2 block instead.
+	y2 [16]int16
+	y  [16][16]int16
+	u  [4][16]int16
+	v  [4][16]int16
+	// Every coefficient is zero
+	skip bool
+}
+
+type vp8Encoder struct {
+	width  int
+	height int
+	// Size in macroblocks
+	mbw int
+	mbh int
+	// Source and reconstructed planes, padded to whole macroblocks
+	srcY     []uint8
+	srcU     []uint8
+	srcV     []uint8
+	recY     []uint8
+	recU     []uint8
+	recV     []uint8
+	yStride  int
+	uvStride int
+
+	qIndex      int
+	quant       vp8Quantizer
+	macroblocks []vp8Macroblock
+}
+
+// Encode the image as a VP8 key frame, with a quality from MinQuality to MaxQuality
+func encodeVP8(img *image.NRGBA, quality int) ([]byte, error) {
+	e, err := newVP8Encoder(img, quality)
+	if err != nil {
+		return nil, err
+	}
+	return e.writeFrame()
+}
+
+// Predict and quantize every macroblock of the image
+func newVP8Encoder(img *image.NRGBA, quality int) (*vp8Encoder, error) {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if width == 0 || height == 0 || width > maxVP8Size || height > maxVP8Size {
+		return nil, fmt.Errorf("webp: lossy frame size %vx%v must be between 1x1 and %vx%v", width, height, maxVP8Size, maxVP8Size)
+	}
+
+	e := &vp8Encoder{
+		width:  width,
+		height: height,
+		mbw:    (width + 15) / 16,
+		mbh:    (height + 15) / 16,
+		qIndex: getQuantizerIndex(quality),
+	}
+	e.quant = newVP8Quantizer(e.qIndex)
+	e.importImage(img)
+	e.macroblocks = make([]vp8Macroblock, e.mbw*e.mbh)
+	for mby := 0; mby < e.mbh; mby++ {
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			e.encodeMacroblock(&e.macroblocks[mby*e.mbw+mbx], mbx, mby)
+		}
+	}
+	return e, nil
+}
+
+func rgbToY(r int, g int, b int) uint8 {
+	return uint8((16839*r + 33059*g + 6420*b + 1<<15 + 16<<16) >> 16)
+}
+
+// The color is the sum of four pixels
+func clipUV(uv int) uint8 {
+	uv = (uv + 1<<17 + 128<<18) >> 18
+	return uint8(min(max(uv, 0), 255))
+}
+
+// Convert to BT.601 YUV with the chroma averaged over each 2x2 block, the same as libwebp.
+// The padding past the edge of the image repeats the last row and column.
+func (e *vp8Encoder) importImage(img *image.NRGBA) {
+	e.yStride = e.mbw * 16
+	e.uvStride = e.mbw * 8
+	e.srcY = make([]uint8, e.yStride*e.mbh*16)
+	e.srcU = make([]uint8, e.uvStride*e.mbh*8)
+	e.srcV = make([]uint8, e.uvStride*e.mbh*8)
+	e.recY = make([]uint8, len(e.srcY))
+	e.recU = make([]uint8, len(e.srcU))
+	e.recV = make([]uint8, len(e.srcV))
+
+	getPixel := func(x int, y int) (int, int, int) {
+		i := img.PixOffset(min(x, e.width-1), min(y, e.height-1))
+		return int(img.Pix[i]), int(img.Pix[i+1]), int(img.Pix[i+2])
+	}
+	for y := 0; y < e.mbh*16; y++ {
+		for x := 0; x < e.yStride; x++ {
+			e.srcY[y*e.yStride+x] = rgbToY(getPixel(x, y))
+		}
+	}
+	for y := 0; y < e.mbh*8; y++ {
+		for x := 0; x < e.uvStride; x++ {
+			sumR, sumG, sumB := 0, 0, 0
+			for dy := 0; dy < 2; dy++ {
+				for dx := 0; dx < 2; dx++ {
+					r, g, b := getPixel(2*x+dx, 2*y+dy)
+					sumR += r
+					sumG += g
+					sumB += b
+				}
+			}
+			e.srcU[y*e.uvStride+x] = clipUV(-9719*sumR - 19081*sumG + 28800*sumB)
+			e.srcV[y*e.uvStride+x] = clipUV(28800*sumR - 24116*sumG - 4684*sumB)
+		}
+	}
+}
+
+// Reconstructed samples above and left of a block.
+// Outside of the image, the spec uses 127 above and 129 to the left.
+type predictionEdges struct {
+	top     [16]uint8
+	left    [16]uint8
+	topLeft uint8
+	hasTop  bool
+	hasLeft bool
+}
+
+func getPredictionEdges(rec []uint8, stride int, x0 int, y0 int, size int) predictionEdges {
+	edges := predictionEdges{hasTop: y0 > 0, hasLeft: x0 > 0}
+	for i := 0; i < size; i++ {
+		edges.top[i] = 127
+		if edges.hasTop {
+			edges.top[i] = rec[(y0-1)*stride+x0+i]
+		}
+		edges.left[i] = 129
+		if edges.hasLeft {
+			edges.left[i] = rec[(y0+i)*stride+x0-1]
+		}
+	}
+	if !edges.hasTop {
+		edges.topLeft = 127
+	} else if !edges.hasLeft {
+		edges.topLeft = 129
+	} else {
+		edges.topLeft = rec[(y0-1)*stride+x0-1]
+	}
+	return edges
+}
+
+// Fill the size x size prediction, which has a stride of size
+func predictBlock(mode uint8, edges *predictionEdges, size int, pred []uint8) {
+	switch mode {
+	case predDC:
+		// Blocks on the edge of the image only average the edges they have
+		value := 128
+		if edges.hasTop && edges.hasLeft {
+			sum := size
+			for i := 0; i < size; i++ {
+				sum += int(edges.top[i]) + int(edges.left[i])
+			}
+			value = sum / (2 * size)
+		} else if edges.hasTop || edges.hasLeft {
+			sum := size / 2
+			for i := 0; i < size; i++ {
+				if edges.hasTop {
+					sum += int(edges.top[i])
+				} else {
+					sum += int(edges.left[i])
+				}
+			}
+			value = sum / size
+		}
+		for i := 0; i < size*size; i++ {
+			pred[i] = uint8(value)
+		}
+	case predTM:
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				value := int(edges.left[y]) + int(edges.top[x]) - int(edges.topLeft)
+				pred[y*size+x] = uint8(min(max(value, 0), 255))
+			}
+		}
+	case predVE:
+		for y := 0; y < size; y++ {
+			copy(pred[y*size:(y+1)*size], edges.top[:size])
+		}
+	case predHE:
+		for y := 0; y < size; y++ {
+			for x := 0; x < size; x++ {
+				pred[y*size+x] = edges.left[y]
+			}
+		}
+	}
+}
+
+// Sum of squared differences between the source block and the prediction
+func getPredictionError(src []uint8, stride int, x0 int, y0 int, size int, pred []uint8) int {
+	sum := 0
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			d := int(src[(y0+y)*stride+x0+x]) - int(pred[y*size+x])
+			sum += d * d
+		}
+	}
+	return sum
+}
+
+// Forward DCT of the difference between a 4x4 source block and its prediction, the same as libwebp
+func forwardDCT(src []uint8, srcStride int, pred []uint8, predStride int, out *[16]int32) {
+	var tmp [16]int32
+	for i := 0; i < 4; i++ {
+		d0 := int32(src[i*srcStride+0]) - int32(pred[i*predStride+0])
+		d1 := int32(src[i*srcStride+1]) - int32(pred[i*predStride+1])
+		d2 := int32(src[i*srcStride+2]) - int32(pred[i*predStride+2])
+		d3 := int32(src[i*srcStride+3]) - int32(pred[i*predStride+3])
+		a0 := d0 + d3
+		a1 := d1 + d2
+		a2 := d1 - d2
+		a3 := d0 - d3
+		tmp[0+i*4] = (a0 + a1) * 8
+		tmp[1+i*4] = (a2*2217 + a3*5352 + 1812) >> 9
+		tmp[2+i*4] = (a0 - a1) * 8
+		tmp[3+i*4] = (a3*2217 - a2*5352 + 937) >> 9
+	}
+	for i := 0; i < 4; i++ {
+		a0 := tmp[0+i] + tmp[12+i]
+		a1 := tmp[4+i] + tmp[8+i]
+		a2 := tmp[4+i] - tmp[8+i]
+		a3 := tmp[0+i] - tmp[12+i]
+		out[0+i] = (a0 + a1 + 7) >> 4
+		out[4+i] = (a2*2217 + a3*5352 + 12000) >> 16
+		if a3 != 0 {
+			out[4+i]++
+		}
+		out[8+i] = (a0 - a1 + 7) >> 4
+		out[12+i] = (a3*2217 - a2*5352 + 51000) >> 16
+	}
+}
+
+// Inverse DCT added to the prediction, exactly as the decoder does it
+func inverseDCT(coeffs *[16]int32, pred []uint8, predStride int, dst []uint8, dstStride int) {
+	const (
+		c1 = 85627 // 65536 * cos(pi/8) * sqrt(2)
+		c2 = 35468 // 65536 * sin(pi/8) * sqrt(2)
+	)
+	var m [4][4]int32
+	for i := 0; i < 4; i++ {
+		a := coeffs[i] + coeffs[8+i]
+		b := coeffs[i] - coeffs[8+i]
+		c := (coeffs[4+i]*c2)>>16 - (coeffs[12+i]*c1)>>16
+		d := (coeffs[4+i]*c1)>>16 + (coeffs[12+i]*c2)>>16
+		m[i][0] = a + d
+		m[i][1] = b + c
+		m[i][2] = b - c
+		m[i][3] = a - d
+	}
+	for j := 0; j < 4; j++ {
+		dc := m[0][j] + 4
+		a := dc + m[2][j]
+		b := dc - m[2][j]
+		c := (m[1][j]*c2)>>16 - (m[3][j]*c1)>>16
+		d := (m[1][j]*c1)>>16 + (m[3][j]*c2)>>16
+		residuals := [4]int32{(a + d) >> 3, (b + c) >> 3, (b - c) >> 3, (a - d) >> 3}
+		for i, residual := range residuals {
+			value := int32(pred[j*predStride+i]) + residual
+			dst[j*dstStride+i] = uint8(min(max(value, 0), 255))
+		}
+	}
+}
+
+// Walsh-Hadamard transform of the DC coefficients of the 16 luma blocks, the same as libwebp
+func forwardWHT(dcs *[16]int32, out *[16]int32) {
+	var tmp [16]int32
+	for i := 0; i < 4; i++ {
+		a0 := dcs[i*4+0] + dcs[i*4+2]
+		a1 := dcs[i*4+1] + dcs[i*4+3]
+		a2 := dcs[i*4+1] - dcs[i*4+3]
+		a3 := dcs[i*4+0] - dcs[i*4+2]
+		tmp[0+i*4] = a0 + a1
+		tmp[1+i*4] = a3 + a2
+		tmp[2+i*4] = a3 - a2
+		tmp[3+i*4] = a0 - a1
+	}
+	for i := 0; i < 4; i++ {
+		a0 := tmp[0+i] + tmp[8+i]
+		a1 := tmp[4+i] + tmp[12+i]
+		a2 := tmp[4+i] - tmp[12+i]
+		a3 := tmp[0+i] - tmp[8+i]
+		out[0+i] = (a0 + a1) >> 1
+		out[4+i] = (a3 + a2) >> 1
+		out[8+i] = (a3 - a2) >> 1
+		out[12+i] = (a0 - a1) >> 1
+	}
+}
+
+// Inverse Walsh-Hadamard transform back to the DC coefficient of each luma block, exactly as the decoder does it
+func inverseWHT(coeffs *[16]int32, dcs *[16]int32) {
+	var m [16]int32
+	for i := 0; i < 4; i++ {
+		a0 := coeffs[0+i] + coeffs[12+i]
+		a1 := coeffs[4+i] + coeffs[8+i]
+		a2 := coeffs[4+i] - coeffs[8+i]
+		a3 := coeffs[0+i] - coeffs[12+i]
+		m[0+i] = a0 + a1
+		m[8+i] = a0 - a1
+		m[4+i] = a3 + a2
+		m[12+i] = a3 - a2
+	}
+	for i := 0; i < 4; i++ {
+		dc := m[0+i*4] + 3
+		a0 := dc + m[3+i*4]
+		a1 := m[1+i*4] + m[2+i*4]
+		a2 := m[1+i*4] - m[2+i*4]
+		a3 := dc - m[3+i*4]
+		dcs[i*4+0] = int32(int16((a0 + a1) >> 3))
+		dcs[i*4+1] = int32(int16((a3 + a2) >> 3))
+		dcs[i*4+2] = int32(int16((a0 - a1) >> 3))
+		dcs[i*4+3] = int32(int16((a3 - a2) >> 3))
+	}
+}
+
+// Coefficients before first are left at zero
+func quantizeBlock(coeffs *[16]int32, steps [2]int32, first int, levels *[16]int16) {
+	for i := first; i < 16; i++ {
+		step := steps[min(i, 1)]
+		coeff := coeffs[i]
+		level := (max(coeff, -coeff)*256 + quantBias[min(i, 1)]*step) / (256 * step)
+		level = min(level, maxCoeffLevel)
+		if coeff < 0 {
+			level = -level
+		}
+		levels[i] = int16(level)
+	}
+}
+
+// Coefficients as the decoder stores them
+func dequantizeBlock(levels *[16]int16, steps [2]int32, coeffs *[16]int32) {
+	for i, level := range levels {
+		coeffs[i] = int32(int16(int32(level) * steps[min(i, 1)]))
+	}
+}
+
+func isZeroBlock(levels *[16]int16) bool {
+	for _, level := range levels {
+		if level != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Pick the prediction with the smallest error, over every plane of the block
+func pickPrediction(planes [][]uint8, recs [][]uint8, stride int, x0 int, y0 int, size int) uint8 {
+	bestMode, bestError := uint8(predDC), math.MaxInt
+	pred := make([]uint8, size*size)
+	for mode := uint8(0); mode < numPredModes; mode++ {
+		predictionError := 0
+		for i, src := range planes {
+			edges := getPredictionEdges(recs[i], stride, x0, y0, size)
+			predictBlock(mode, &edges, size, pred)
+			predictionError += getPredictionError(src, stride, x0, y0, size, pred)
+		}
+		if predictionError < bestError {
+			bestMode, bestError = mode, predictionError
+		}
+	}
+	return bestMode
+}
+
+// Pick the prediction modes, quantize the residuals and reconstruct the macroblock as the decoder will see it
+func (e *vp8Encoder) encodeMacroblock(mb *vp8Macroblock, mbx int, mby int) {
+	x0, y0 := mbx*16, mby*16
+	stride := e.yStride
+	mb.lumaMode = pickPrediction([][]uint8{e.srcY}, [][]uint8{e.recY}, stride, x0, y0, 16)
+	edges := getPredictionEdges(e.recY, stride, x0, y0, 16)
+	var pred [16 * 16]uint8
+	predictBlock(mb.lumaMode, &edges, 16, pred[:])
+
+	var coeffs [16][16]int32
+	var dcs, y2Coeffs [16]int32
+	for n := 0; n < 16; n++ {
+		bx, by := x0+(n%4)*4, y0+(n/4)*4
+		forwardDCT(e.srcY[by*stride+bx:], stride, pred[(n/4)*4*16+(n%4)*4:], 16, &coeffs[n])
+		dcs[n] = coeffs[n][0]
+	}
+	forwardWHT(&dcs, &y2Coeffs)
+	quantizeBlock(&y2Coeffs, e.quant.y2, 0, &mb.y2)
+	dequantizeBlock(&mb.y2, e.quant.y2, &y2Coeffs)
+	inverseWHT(&y2Coeffs, &dcs)
+	skip := isZeroBlock(&mb.y2)
+	for n := 0; n < 16; n++ {
+		quantizeBlock(&coeffs[n], e.quant.y1, 1, &mb.y[n])
+		skip = skip && isZeroBlock(&mb.y[n])
+		var block [16]int32
+		dequantizeBlock(&mb.y[n], e.quant.y1, &block)
+		block[0] = dcs[n]
+		bx, by := x0+(n%4)*4, y0+(n/4)*4
+		inverseDCT(&block, pred[(n/4)*4*16+(n%4)*4:], 16, e.recY[by*stride+bx:], stride)
+	}
+
+	x0, y0 = mbx*8, mby*8
+	stride = e.uvStride
+	mb.chromaMode = pickPrediction([][]uint8{e.srcU, e.srcV}, [][]uint8{e.recU, e.recV}, stride, x0, y0, 8)
+	chromaBlocks := []struct {
+		src    []uint8
+		rec    []uint8
+		levels *[4][16]int16
+	}{
+		{e.srcU, e.recU, &mb.u},
+		{e.srcV, e.recV, &mb.v},
+	}
+	for _, chroma := range chromaBlocks {
+		edges := getPredictionEdges(chroma.rec, stride, x0, y0, 8)
+		predictBlock(mb.chromaMode, &edges, 8, pred[:64])
+		for n := 0; n < 4; n++ {
+			bx, by := x0+(n%2)*4, y0+(n/2)*4
+			var block [16]int32
+			forwardDCT(chroma.src[by*stride+bx:], stride, pred[(n/2)*4*8+(n%2)*4:], 8, &block)
+			quantizeBlock(&block, e.quant.uv, 0, &chroma.levels[n])
+			skip = skip && isZeroBlock(&chroma.levels[n])
+			dequantizeBlock(&chroma.levels[n], e.quant.uv, &block)
+			inverseDCT(&block, pred[(n/2)*4*8+(n%2)*4:], 8, chroma.rec[by*stride+bx:], stride)
+		}
+	}
+	mb.skip = skip
+}
+
+// Whether the blocks to the left and above had any coefficients, which picks the token probabilities of the next block
+type nonZeroContext struct {
+	y2 uint8
+	y  [4]uint8
+	u  [2]uint8
+	v  [2]uint8
+}
+
+type tokenCounts [numPlanes][numBands][numContexts][numProbs][2]int
+
+// Writes the coefficient tokens, or only counts the branches taken if there is no encoder
+type tokenWriter struct {
+	enc    *boolEncoder
+	probs  *tokenProbs
+	counts *tokenCounts
+}
+
+func (t *tokenWriter) putTokenBit(bit bool, plane int, band uint8, context uint8, probIndex int) {
+	if t.enc == nil {
+		if bit {
+			t.counts[plane][band][context][probIndex][1]++
+		} else {
+			t.counts[plane][band][context][probIndex][0]++
+		}
+		return
+	}
+	t.enc.putBit(bit, t.probs[plane][band][context][probIndex])
+}
+
+// Extra bits have fixed probabilities
+func (t *tokenWriter) putExtraBit(bit bool, prob uint8) {
+	if t.enc != nil {
+		t.enc.putBit(bit, prob)
+	}
+}
+
+// Token tree for the size of a coefficient, as specified in section 13.2
+func (t *tokenWriter) putLevel(level int, plane int, band uint8, context uint8) {
+	if level == 1 {
+		t.putTokenBit(false, plane, band, context, 2)
+		return
+	}
+	t.putTokenBit(true, plane, band, context, 2)
+	if level <= 4 {
+		t.putTokenBit(false, plane, band, context, 3)
+		if level == 2 {
+			t.putTokenBit(false, plane, band, context, 4)
+		} else {
+			t.putTokenBit(true, plane, band, context, 4)
+			t.putTokenBit(level == 4, plane, band, context, 5)
+		}
+		return
+	}
+	t.putTokenBit(true, plane, band, context, 3)
+	if level <= 10 {
+		t.putTokenBit(false, plane, band, context, 6)
+		if level <= 6 {
+			// DCT_CAT1
+			t.putTokenBit(false, plane, band, context, 7)
+			t.putExtraBit(level == 6, 159)
+		} else {
+			// DCT_CAT2
+			t.putTokenBit(true, plane, band, context, 7)
+			t.putExtraBit(level >= 9, 165)
+			t.putExtraBit((level-7)&1 != 0, 145)
+		}
+		return
+	}
+	t.putTokenBit(true, plane, band, context, 6)
+	// DCT_CAT3 to DCT_CAT6 start at 11, 19, 35 and 67
+	category := 3
+	for category > 0 && level < 3+(8<<category) {
+		category--
+	}
+	t.putTokenBit(category >= 2, plane, band, context, 8)
+	t.putTokenBit(category&1 != 0, plane, band, context, 9+category/2)
+	extra := level - (3 + (8 << category))
+	extraProbs := cat3456Probs[category]
+	for i, prob := range extraProbs {
+		t.putExtraBit((extra>>(len(extraProbs)-1-i))&1 != 0, prob)
+	}
+}
+
+// Write the coefficients of a block from first on and return 1 if any weren't zero
+func (t *tokenWriter) putBlock(plane int, context uint8, levels *[16]int16, first int) uint8 {
+	last := -1
+	for n := first; n < 16; n++ {
+		if levels[zigzag[n]] != 0 {
+			last = n
+		}
+	}
+	n := first
+	band := coeffBands[n]
+	if last < 0 {
+		// End of block
+		t.putTokenBit(false, plane, band, context, 0)
+		return 0
+	}
+	for n <= last {
+		t.putTokenBit(true, plane, band, context, 0)
+		// A zero is never followed by the end of the block, so there's no end of block bit after it
+		for levels[zigzag[n]] == 0 {
+			t.putTokenBit(false, plane, band, context, 1)
+			n++
+			band = coeffBands[n]
+			context = 0
+		}
+		t.putTokenBit(true, plane, band, context, 1)
+		level := int(levels[zigzag[n]])
+		t.putLevel(max(level, -level), plane, band, context)
+		t.putExtraBit(level < 0, 128)
+		n++
+		band = coeffBands[n]
+		context = 2
+		if level == 1 || level == -1 {
+			context = 1
+		}
+		if n == 16 {
+			return 1
+		}
+	}
+	t.putTokenBit(false, plane, band, context, 0)
+	return 1
+}
+
+func (t *tokenWriter) putMacroblock(mb *vp8Macroblock, left *nonZeroContext, above *nonZeroContext) {
+	nz := t.putBlock(planeY2, left.y2+above.y2, &mb.y2, 0)
+	left.y2, above.y2 = nz, nz
+	for y := 0; y < 4; y++ {
+		nz := left.y[y]
+		for x := 0; x < 4; x++ {
+			nz = t.putBlock(planeY1WithY2, nz+above.y[x], &mb.y[y*4+x], 1)
+			above.y[x] = nz
+		}
+		left.y[y] = nz
+	}
+	chromaBlocks := []struct {
+		levels *[4][16]int16
+		left   *[2]uint8
+		above  *[2]uint8
+	}{
+		{&mb.u, &left.u, &above.u},
+		{&mb.v, &left.v, &above.v},
+	}
+	for _, chroma := range chromaBlocks {
+		for y := 0; y < 2; y++ {
+			nz := chroma.left[y]
+			for x := 0; x < 2; x++ {
+				nz = t.putBlock(planeUV, nz+chroma.above[x], &chroma.levels[y*2+x], 0)
+				chroma.above[x] = nz
+			}
+			chroma.left[y] = nz
+		}
+	}
+}
+
+// Skipped macroblocks have no tokens, and the decoder treats them as blocks without coefficients
+func (e *vp8Encoder) putTokens(t *tokenWriter, useSkip bool) {
+	above := make([]nonZeroContext, e.mbw)
+	for mby := 0; mby < e.mbh; mby++ {
+		left := nonZeroContext{}
+		for mbx := 0; mbx < e.mbw; mbx++ {
+			mb := &e.macroblocks[mby*e.mbw+mbx]
+			if useSkip && mb.skip {
+				left = nonZeroContext{}
+				above[mbx] = nonZeroContext{}
+				continue
+			}
+			t.putMacroblock(mb, &left, &above[mbx])
+		}
+	}
+}
+
+// Cost in bits of a bit with the probability
+func getBitCost(bit bool, prob uint8) float64 {
+	p := float64(prob) / 256
+	if bit {
+		p = 1 - p
+	}
+	return -math.Log2(p)
+}
+
+// Token probabilities that fit the counted tokens,
+// where the bits saved are more than the cost of sending the new probability in the frame header
+func getTokenProbs(counts *tokenCounts) tokenProbs {
+	probs := defaultTokenProbs
+	for plane := range probs {
+		for band := range probs[plane] {
+			for context := range probs[plane][band] {
+				for i, oldProb := range probs[plane][band][context] {
+					zeros, ones := counts[plane][band][context][i][0], counts[plane][band][context][i][1]
+					total := zeros + ones
+					if total == 0 {
+						continue
+					}
+					newProb := uint8(min(max((zeros*256+total/2)/total, 1), 255))
+					updateProb := tokenProbUpdateProbs[plane][band][context][i]
+					oldCost := float64(zeros)*getBitCost(false, oldProb) + float64(ones)*getBitCost(true, oldProb) + getBitCost(false, updateProb)
+					newCost := float64(zeros)*getBitCost(false, newProb) + float64(ones)*getBitCost(true, newProb) + getBitCost(true, updateProb) + 8
+					if newCost < oldCost {
+						probs[plane][band][context][i] = newProb
+					}
+				}
+			}
+		}
+	}
+	return probs
+}
+
+// Write the frame header, the first partition with the modes of every macroblock and the partition with the tokens
+func (e *vp8Encoder) writeFrame() ([]byte, error) {
+	// The skip flag is left out if no macroblock can be skipped
+	skipCount := 0
+	for _, mb := range e.macroblocks {
+		if mb.skip {
+			skipCount++
+		}
+	}
+	useSkip := skipCount > 0
+	skipProb := uint8(min(max(255-skipCount*255/len(e.macroblocks), 1), 255))
+
+	var counts tokenCounts
+	e.putTokens(&tokenWriter{counts: &counts}, useSkip)
+	probs := getTokenProbs(&counts)
+
+	first := newBoolEncoder()
+	// Color space and clamping type
+	first.putBit(false, 128)
+	first.putBit(false, 128)
+	// No segments
+	first.putBit(false, 128)
+	// Normal loop filter with a level and sharpness of zero, which turns it off, and no filter adjustments
+	first.putBit(false, 128)
+	first.putLiteral(0, 6)
+	first.putLiteral(0, 3)
+	first.putBit(false, 128)
+	// One token partition
+	first.putLiteral(0, 2)
+	// Quantizer index, without any deltas for the DC, Y2 or chroma coefficients
+	first.putLiteral(e.qIndex, 7)
+	for i := 0; i < 5; i++ {
+		first.putBit(false, 128)
+	}
+	// Refresh entropy probs, which only matters for later frames of a video
+	first.putBit(false, 128)
+	for plane := range probs {
+		for band := range probs[plane] {
+			for context := range probs[plane][band] {
+				for i, prob := range probs[plane][band][context] {
+					update := prob != defaultTokenProbs[plane][band][context][i]
+					first.putBit(update, tokenProbUpdateProbs[plane][band][context][i])
+					if update {
+						first.putLiteral(int(prob), 8)
+					}
+				}
+			}
+		}
+	}
+	first.putBit(useSkip, 128)
+	if useSkip {
+		first.putLiteral(int(skipProb), 8)
+	}
+
+	// Prediction trees from sections 11.2 and 11.4
+	for _, mb := range e.macroblocks {
+		if useSkip {
+			first.putBit(mb.skip, skipProb)
+		}
+		// 16x16 luma prediction instead of 4x4 blocks
+		first.putBit(true, 145)
+		switch mb.lumaMode {
+		case predDC:
+			first.putBit(false, 156)
+			first.putBit(false, 163)
+		case predVE:
+			first.putBit(false, 156)
+			first.putBit(true, 163)
+		case predHE:
+			first.putBit(true, 156)
+			first.putBit(false, 128)
+		case predTM:
+			first.putBit(true, 156)
+			first.putBit(true, 128)
+		}
+		first.putBit(mb.chromaMode != predDC, 142)
+		if mb.chromaMode != predDC {
+			first.putBit(mb.chromaMode != predVE, 114)
+			if mb.chromaMode != predVE {
+				first.putBit(mb.chromaMode != predHE, 183)
+			}
+		}
+	}
+	firstPartition := first.finish()
+	if len(firstPartition) > maxFirstPartitionSize {
+		return nil, fmt.Errorf("webp: first partition of %v bytes is too large", len(firstPartition))
+	}
+
+	tokens := newBoolEncoder()
+	e.putTokens(&tokenWriter{enc: tokens, probs: &probs}, useSkip)
+	tokenPartition := tokens.finish()
+
+	// Key frame, version 0 and shown, followed by the start code and the size without scaling
+	frame := make([]byte, 10, 10+len(firstPartition)+len(tokenPartition))
+	putUint24(frame[0:3], 1<<4|len(firstPartition)<<5)
+	copy(frame[3:6], []byte{0x9d, 0x01, 0x2a})
+	frame[6], frame[7] = byte(e.width), byte(e.width>>8)
+	frame[8], frame[9] = byte(e.height), byte(e.height>>8)
+	frame = append(frame, firstPartition...)
+	return append(frame, tokenPartition...), nil
+}
@@ -0,0 +1,311 @@
+// Package webp writes animated WebP files.
+// Frames are stored as lossless VP8L by default, or as lossy VP8 with a separate alpha channel for a much smaller file.
+// Lossless frames can also be reduced to fewer colors before they are encoded.
+package webp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"io"
+	"math"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/samuelyuan/PolytopiaMapImage/graphics/quantize"
+)
+
+const (
+	vp8xFlagAnimation = 0x02
+	vp8xFlagAlpha     = 0x10
+
+	anmfFlagNoBlend = 0x02
+
+	// Longest frame duration that fits in the 24 bit field, in milliseconds
+	MaxDelay = 0xffffff
+
+	// Size of the RIFF, WEBP and chunk header written by nativewebp before the VP8L chunk
+	riffHeaderSize = 12
+	// Size of the header at the start of VP8L data, which is left out of compressed alpha
+	vp8lHeaderSize = 5
+
+	alphCompressionLossless = 1
+)
+
+const (
+	MinReduceColors = 2
+	MaxReduceColors = 256
+)
+
+type Options struct {
+	// Store frames as lossy VP8 instead of lossless VP8L
+	Lossy bool
+	// MinQuality to MaxQuality for lossy frames, higher keeps more detail. Zero uses DefaultQuality.
+	Quality int
+	// Reduce each lossless frame to this many colors to get a smaller file, or zero to keep every color
+	ReduceColors int
+	// A loop count of zero repeats the animation forever
+	LoopCount int
+}
+
+// Frames are written as they are encoded when the writer can seek, such as a file,
+// since the RIFF header is patched with the total size at the end.
+// Otherwise the frames are kept in memory until Close.
+type Encoder struct {
+	w       io.Writer
+	options Options
+
+	width      int
+	height     int
+	frameCount int
+	// Size of the RIFF chunk written so far, which starts with the WEBP tag
+	riffSize int64
+
+	// Only set if the frames are streamed, to patch the size in the RIFF header at riffStart
+	seeker    io.WriteSeeker
+	riffStart int64
+	// Frames kept until Close if the writer can't seek
+	frames bytes.Buffer
+}
+
+func NewEncoder(w io.Writer, options Options) *Encoder {
+	return &Encoder{
+		w:       w,
+		options: options,
+	}
+}
+
+func putUint24(b []byte, v int) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
+
+// Size of a chunk with its header and padding
+func getChunkSize(dataSize int) int64 {
+	return int64(8 + dataSize + dataSize%2)
+}
+
+func writeChunk(w io.Writer, chunkType string, data []byte) error {
+	header := make([]byte, 8)
+	copy(header[0:4], chunkType)
+	binary.LittleEndian.PutUint32(header[4:8], uint32(len(data)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	// Chunks are padded to an even size
+	if len(data)%2 != 0 {
+		if _, err := w.Write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The alpha of a lossy frame is stored losslessly in the green channel of a VP8L image without its header.
+// Returns nil if the frame is opaque.
+func encodeAlpha(img *image.NRGBA) ([]byte, error) {
+	opaque := true
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] != 255 {
+			opaque = false
+			break
+		}
+	}
+	if opaque {
+		return nil, nil
+	}
+
+	alphaImage := image.NewNRGBA(img.Bounds())
+	for i := 3; i < len(img.Pix); i += 4 {
+		alphaImage.Pix[i-2] = img.Pix[i]
+		alphaImage.Pix[i] = 255
+	}
+	var buf bytes.Buffer
+	if err := nativewebp.Encode(&buf, alphaImage, nil); err != nil {
+		return nil, err
+	}
+	if buf.Len() < riffHeaderSize+8+vp8lHeaderSize {
+		return nil, errors.New("webp: encoded alpha is too short")
+	}
+	vp8lChunk := buf.Bytes()[riffHeaderSize:]
+	vp8lSize := int(binary.LittleEndian.Uint32(vp8lChunk[4:8]))
+	if vp8lSize < vp8lHeaderSize || 8+vp8lSize > len(vp8lChunk) {
+		return nil, errors.New("webp: encoded alpha has the wrong size")
+	}
+	alph := []byte{alphCompressionLossless}
+	return append(alph, vp8lChunk[8+vp8lHeaderSize:8+vp8lSize]...), nil
+}
+
+// Lossy frames are an ALPH chunk, if the frame has transparency, followed by a VP8 chunk
+func (e *Encoder) encodeLossyFrameImage(img image.Image) ([]byte, error) {
+	bounds := img.Bounds()
+	nrgba := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(nrgba, nrgba.Bounds(), img, bounds.Min, draw.Src)
+
+	quality := e.options.Quality
+	if quality == 0 {
+		quality = DefaultQuality
+	}
+	vp8, err := encodeVP8(nrgba, quality)
+	if err != nil {
+		return nil, err
+	}
+	alpha, err := encodeAlpha(nrgba)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if alpha != nil {
+		writeChunk(&buf, "ALPH", alpha)
+	}
+	writeChunk(&buf, "VP8 ", vp8)
+	return buf.Bytes(), nil
+}
+
+func (e *Encoder) encodeFrameImage(img image.Image) ([]byte, error) {
+	if e.options.Lossy {
+		return e.encodeLossyFrameImage(img)
+	}
+	if e.options.ReduceColors > 0 {
+		bounds := img.Bounds()
+		palettedImage := image.NewPaletted(bounds, nil)
+		quantizer := quantize.MedianCutQuantizer{NumColor: min(e.options.ReduceColors, MaxReduceColors)}
+		quantizer.Quantize(palettedImage, bounds, img, bounds.Min)
+
+		// nativewebp stores paletted images with a color table, but doesn't bundle the pixels
+		// as required for tables of 16 colors or less, so the reduced colors are stored as RGBA
+		reducedImage := image.NewNRGBA(bounds)
+		draw.Draw(reducedImage, bounds, palettedImage, bounds.Min, draw.Src)
+		img = reducedImage
+	}
+
+	var buf bytes.Buffer
+	if err := nativewebp.Encode(&buf, img, nil); err != nil {
+		return nil, err
+	}
+	if buf.Len() < riffHeaderSize {
+		return nil, errors.New("webp: encoded frame is too short")
+	}
+	// Keep only the VP8L chunk
+	return buf.Bytes()[riffHeaderSize:], nil
+}
+
+// Write a frame shown for the delay in milliseconds, up to MaxDelay.
+// The first frame sets the canvas size. Later frames can be smaller and are placed at their bounds,
+// which must start at even coordinates.
+func (e *Encoder) WriteFrame(img image.Image, delay int) error {
+	bounds := img.Bounds()
+	if e.frameCount == 0 {
+		if bounds.Min != (image.Point{}) {
+			return errors.New("webp: first frame must start at the origin")
+		}
+		e.width = bounds.Dx()
+		e.height = bounds.Dy()
+		if err := e.startFrames(); err != nil {
+			return err
+		}
+	} else if !bounds.In(image.Rect(0, 0, e.width, e.height)) {
+		return fmt.Errorf("webp: frame with bounds %v is outside of the canvas", bounds)
+	}
+	if bounds.Min.X%2 != 0 || bounds.Min.Y%2 != 0 {
+		return fmt.Errorf("webp: frame offset %v must be even", bounds.Min)
+	}
+
+	frameData, err := e.encodeFrameImage(img)
+	if err != nil {
+		return fmt.Errorf("webp: failed to encode frame: %w", err)
+	}
+
+	anmf := make([]byte, 16, 16+len(frameData))
+	putUint24(anmf[0:3], bounds.Min.X/2)
+	putUint24(anmf[3:6], bounds.Min.Y/2)
+	putUint24(anmf[6:9], bounds.Dx()-1)
+	putUint24(anmf[9:12], bounds.Dy()-1)
+	putUint24(anmf[12:15], min(max(delay, 0), MaxDelay))
+	anmf[15] = anmfFlagNoBlend
+	anmf = append(anmf, frameData...)
+
+	var w io.Writer = &e.frames
+	if e.seeker != nil {
+		w = e.w
+	}
+	if err := writeChunk(w, "ANMF", anmf); err != nil {
+		return err
+	}
+	e.frameCount++
+	e.riffSize += getChunkSize(len(anmf))
+	return nil
+}
+
+// Chunks before the first frame. The RIFF size is only known once every frame is written.
+func (e *Encoder) writeHeader(w io.Writer, riffSize int64) error {
+	header := make([]byte, 12)
+	copy(header[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], uint32(riffSize))
+	copy(header[8:12], "WEBP")
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	vp8x := make([]byte, 10)
+	vp8x[0] = vp8xFlagAnimation | vp8xFlagAlpha
+	putUint24(vp8x[4:7], e.width-1)
+	putUint24(vp8x[7:10], e.height-1)
+	if err := writeChunk(w, "VP8X", vp8x); err != nil {
+		return err
+	}
+
+	anim := make([]byte, 6)
+	// The background color is left transparent
+	binary.LittleEndian.PutUint16(anim[4:6], uint16(e.options.LoopCount))
+	return writeChunk(w, "ANIM", anim)
+}
+
+// Start streaming the frames if the writer can seek back to the RIFF header
+func (e *Encoder) startFrames() error {
+	e.riffSize = 4 + getChunkSize(10) + getChunkSize(6)
+	if seeker, ok := e.w.(io.WriteSeeker); ok {
+		if riffStart, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			e.seeker = seeker
+			e.riffStart = riffStart
+			return e.writeHeader(e.w, 0)
+		}
+	}
+	return nil
+}
+
+func (e *Encoder) Close() error {
+	if e.frameCount == 0 {
+		return errors.New("webp: no frames to write")
+	}
+	if e.riffSize > math.MaxUint32 {
+		return fmt.Errorf("webp: file size %v is too large", e.riffSize)
+	}
+
+	if e.seeker == nil {
+		if err := e.writeHeader(e.w, e.riffSize); err != nil {
+			return err
+		}
+		_, err := e.frames.WriteTo(e.w)
+		return err
+	}
+
+	// Patch the RIFF size and move back to the end of the file
+	if _, err := e.seeker.Seek(e.riffStart+4, io.SeekStart); err != nil {
+		return err
+	}
+	riffSize := make([]byte, 4)
+	binary.LittleEndian.PutUint32(riffSize, uint32(e.riffSize))
+	if _, err := e.seeker.Write(riffSize); err != nil {
+		return err
+	}
+	_, err := e.seeker.Seek(e.riffStart+8+e.riffSize, io.SeekStart)
+	return err
+}
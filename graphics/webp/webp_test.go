@@ -0,0 +1,412 @@
+package webp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/samuelyuan/PolytopiaMapImage/graphics/internal/imagetest"
+	xwebp "golang.org/x/image/webp"
+)
+
+type riffChunk struct {
+	chunkType string
+	data      []byte
+}
+
+func getUint24(b []byte) int {
+	return int(b[0]) | int(b[1])<<8 | int(b[2])<<16
+}
+
+// Split the chunk data into chunks, checking that every chunk length fits and odd chunks are padded
+func readChunks(t *testing.T, data []byte) []riffChunk {
+	chunks := make([]riffChunk, 0)
+	for offset := 0; offset < len(data); {
+		if offset+8 > len(data) {
+			t.Fatalf("truncated chunk header at offset %v", offset)
+		}
+		chunkType := string(data[offset : offset+4])
+		length := int(binary.LittleEndian.Uint32(data[offset+4 : offset+8]))
+		end := offset + 8 + length + length%2
+		if end > len(data) {
+			t.Fatalf("%v chunk at offset %v with length %v is past the end of the data", chunkType, offset, length)
+		}
+		chunks = append(chunks, riffChunk{chunkType: chunkType, data: data[offset+8 : offset+8+length]})
+		offset = end
+	}
+	return chunks
+}
+
+// Check the RIFF header and return the chunks inside it
+func readFile(t *testing.T, data []byte) []riffChunk {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		t.Fatal("missing RIFF WEBP header")
+	}
+	if riffSize := int(binary.LittleEndian.Uint32(data[4:8])); riffSize != len(data)-8 {
+		t.Fatalf("RIFF size is %v, expected %v", riffSize, len(data)-8)
+	}
+	return readChunks(t, data[12:])
+}
+
+// Decode the chunks of a frame on their own. Lossy frames with alpha need a VP8X chunk
+// with the alpha flag and the frame size from the VP8 frame header.
+func decodeFrameData(t *testing.T, frameData []byte) image.Image {
+	var header bytes.Buffer
+	frameChunks := readChunks(t, frameData)
+	if frameChunks[0].chunkType == "ALPH" {
+		vp8 := frameChunks[len(frameChunks)-1].data
+		vp8x := make([]byte, 10)
+		vp8x[0] = vp8xFlagAlpha
+		putUint24(vp8x[4:7], int(binary.LittleEndian.Uint16(vp8[6:8])&0x3fff)-1)
+		putUint24(vp8x[7:10], int(binary.LittleEndian.Uint16(vp8[8:10])&0x3fff)-1)
+		writeChunk(&header, "VP8X", vp8x)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(4+header.Len()+len(frameData)))
+	buf.WriteString("WEBP")
+	buf.Write(header.Bytes())
+	buf.Write(frameData)
+	img, err := xwebp.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+var (
+	testFrames = []image.Image{
+		imagetest.BuildFrame(image.Rect(0, 0, 7, 5), 0),
+		imagetest.BuildFrame(image.Rect(2, 2, 5, 5), 9),
+		imagetest.BuildFrame(image.Rect(0, 0, 7, 5), 21),
+	}
+	testDelays = []int{1000, 200, MaxDelay + 1}
+)
+
+func encodeTestFrames(t *testing.T, e *Encoder) {
+	for i, frame := range testFrames {
+		if err := e.WriteFrame(frame, testDelays[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncodeRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	encodeTestFrames(t, NewEncoder(&buf, Options{LoopCount: 3}))
+
+	chunks := readFile(t, buf.Bytes())
+	if len(chunks) != 2+len(testFrames) {
+		t.Fatalf("got %v chunks, expected %v", len(chunks), 2+len(testFrames))
+	}
+
+	vp8x := chunks[0]
+	if vp8x.chunkType != "VP8X" || len(vp8x.data) != 10 {
+		t.Fatalf("first chunk is %v with length %v, expected VP8X with length 10", vp8x.chunkType, len(vp8x.data))
+	}
+	if vp8x.data[0]&vp8xFlagAnimation == 0 {
+		t.Fatal("VP8X doesn't have the animation flag")
+	}
+	if width, height := getUint24(vp8x.data[4:7])+1, getUint24(vp8x.data[7:10])+1; width != 7 || height != 5 {
+		t.Fatalf("canvas is %vx%v, expected 7x5", width, height)
+	}
+
+	anim := chunks[1]
+	if anim.chunkType != "ANIM" || len(anim.data) != 6 {
+		t.Fatalf("second chunk is %v with length %v, expected ANIM with length 6", anim.chunkType, len(anim.data))
+	}
+	if loopCount := binary.LittleEndian.Uint16(anim.data[4:6]); loopCount != 3 {
+		t.Fatalf("loop count is %v, expected 3", loopCount)
+	}
+
+	for i, frame := range testFrames {
+		anmf := chunks[2+i]
+		if anmf.chunkType != "ANMF" {
+			t.Fatalf("chunk %v is %v, expected ANMF", 2+i, anmf.chunkType)
+		}
+		bounds := frame.Bounds()
+		x, y := getUint24(anmf.data[0:3])*2, getUint24(anmf.data[3:6])*2
+		width, height := getUint24(anmf.data[6:9])+1, getUint24(anmf.data[9:12])+1
+		if image.Rect(x, y, x+width, y+height) != bounds {
+			t.Fatalf("frame %v has bounds %v,%v %vx%v, expected %v", i, x, y, width, height, bounds)
+		}
+		if delay := getUint24(anmf.data[12:15]); delay != min(testDelays[i], MaxDelay) {
+			t.Fatalf("frame %v has delay %v, expected %v", i, delay, min(testDelays[i], MaxDelay))
+		}
+
+		// The frame data is a single VP8L chunk that fills the rest of the ANMF chunk
+		frameChunks := readChunks(t, anmf.data[16:])
+		if len(frameChunks) != 1 || frameChunks[0].chunkType != "VP8L" {
+			t.Fatalf("frame %v doesn't have a single VP8L chunk", i)
+		}
+		imagetest.AssertSamePixels(t, "frame", frame, decodeFrameData(t, anmf.data[16:]))
+	}
+}
+
+// Files are written as the frames are encoded, with the RIFF size patched at the end
+func TestEncodeStreamed(t *testing.T) {
+	var buf bytes.Buffer
+	encodeTestFrames(t, NewEncoder(&buf, Options{}))
+
+	outputFile, err := os.Create(filepath.Join(t.TempDir(), "replay.webp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outputFile.Close()
+	// The file doesn't have to start at the RIFF header
+	prefix := []byte("prefix")
+	outputFile.Write(prefix)
+
+	encoder := NewEncoder(outputFile, Options{})
+	if err := encoder.WriteFrame(testFrames[0], testDelays[0]); err != nil {
+		t.Fatal(err)
+	}
+	if encoder.frames.Len() != 0 {
+		t.Fatal("frame was kept in memory instead of written to the file")
+	}
+	for i := 1; i < len(testFrames); i++ {
+		if err := encoder.WriteFrame(testFrames[i], testDelays[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Anything written after Close goes to the end of the file
+	outputFile.Write([]byte("!"))
+
+	result, err := os.ReadFile(outputFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := append(append(prefix, buf.Bytes()...), '!')
+	if !bytes.Equal(result, expected) {
+		t.Fatal("streamed file is different from the file encoded in memory")
+	}
+}
+
+func TestEncodeReduceColors(t *testing.T) {
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf, Options{ReduceColors: 4})
+	if err := encoder.WriteFrame(testFrames[0], 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := readFile(t, buf.Bytes())
+	frame := decodeFrameData(t, chunks[2].data[16:])
+	if colorCount := imagetest.CountColors(frame); colorCount > 4 {
+		t.Fatalf("frame has %v colors, expected at most 4", colorCount)
+	}
+}
+
+func TestEncodeInvalidFrames(t *testing.T) {
+	encoder := NewEncoder(&bytes.Buffer{}, Options{})
+	if err := encoder.Close(); err == nil {
+		t.Fatal("expected an error for a WebP without frames")
+	}
+
+	encoder = NewEncoder(&bytes.Buffer{}, Options{})
+	if err := encoder.WriteFrame(imagetest.BuildFrame(image.Rect(2, 2, 4, 4), 0), 100); err == nil {
+		t.Fatal("expected an error for a first frame that doesn't start at the origin")
+	}
+
+	encoder = NewEncoder(&bytes.Buffer{}, Options{})
+	if err := encoder.WriteFrame(imagetest.BuildFrame(image.Rect(0, 0, 4, 4), 0), 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := encoder.WriteFrame(imagetest.BuildFrame(image.Rect(1, 2, 3, 4), 0), 100); err == nil {
+		t.Fatal("expected an error for a frame at an odd offset")
+	}
+	if err := encoder.WriteFrame(imagetest.BuildFrame(image.Rect(2, 2, 6, 6), 0), 100); err == nil {
+		t.Fatal("expected an error for a frame outside of the canvas")
+	}
+}
+
+// Smooth colors with a transparent corner, since sharp color edges lose detail to the chroma subsampling
+func buildLossyTestFrame(bounds image.Rectangle) *image.NRGBA {
+	img := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			alpha := uint8(255)
+			if x-bounds.Min.X < 8 && y-bounds.Min.Y < 8 {
+				alpha = uint8((x - bounds.Min.X) * (y - bounds.Min.Y) * 4)
+			}
+			img.SetNRGBA(x, y, color.NRGBA{uint8(40 + x*4), uint8(200 - y*3), uint8(100 + x + y), alpha})
+		}
+	}
+	return img
+}
+
+// Convert the decoded BT.601 colors the same way as libwebp and browsers,
+// since the standard library treats them as full range JPEG colors
+func getLossyPixel(img image.Image, x int, y int) color.NRGBA {
+	var ycbcr *image.YCbCr
+	alpha := uint8(255)
+	switch decoded := img.(type) {
+	case *image.YCbCr:
+		ycbcr = decoded
+	case *image.NYCbCrA:
+		ycbcr = &decoded.YCbCr
+		alpha = decoded.A[decoded.AOffset(x, y)]
+	default:
+		panic("lossy frame isn't decoded as YCbCr")
+	}
+	luma := 1.164 * (float64(ycbcr.Y[ycbcr.YOffset(x, y)]) - 16)
+	cb := float64(ycbcr.Cb[ycbcr.COffset(x, y)]) - 128
+	cr := float64(ycbcr.Cr[ycbcr.COffset(x, y)]) - 128
+	clip := func(v float64) uint8 {
+		return uint8(min(max(math.Round(v), 0), 255))
+	}
+	return color.NRGBA{clip(luma + 1.596*cr), clip(luma - 0.391*cb - 0.813*cr), clip(luma + 2.018*cb), alpha}
+}
+
+func TestEncodeLossy(t *testing.T) {
+	frames := []image.Image{
+		buildLossyTestFrame(image.Rect(0, 0, 37, 21)),
+		buildLossyTestFrame(image.Rect(10, 4, 30, 21)),
+	}
+	var buf bytes.Buffer
+	encoder := NewEncoder(&buf, Options{Lossy: true, Quality: MaxQuality})
+	for _, frame := range frames {
+		if err := encoder.WriteFrame(frame, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := encoder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := readFile(t, buf.Bytes())
+	for i, frame := range frames {
+		anmf := chunks[2+i]
+		frameChunks := readChunks(t, anmf.data[16:])
+		if len(frameChunks) != 2 || frameChunks[0].chunkType != "ALPH" || frameChunks[1].chunkType != "VP8 " {
+			t.Fatalf("frame %v doesn't have an ALPH chunk followed by a VP8 chunk", i)
+		}
+
+		result := decodeFrameData(t, anmf.data[16:])
+		bounds := frame.Bounds()
+		if result.Bounds().Size() != bounds.Size() {
+			t.Fatalf("frame %v has size %v, expected %v", i, result.Bounds().Size(), bounds.Size())
+		}
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				expected := color.NRGBAModel.Convert(frame.At(x, y)).(color.NRGBA)
+				resultColor := getLossyPixel(result, x-bounds.Min.X, y-bounds.Min.Y)
+				// Alpha is lossless
+				if resultColor.A != expected.A {
+					t.Fatalf("frame %v pixel %v,%v has alpha %v, expected %v", i, x, y, resultColor.A, expected.A)
+				}
+				if expected.A == 0 {
+					continue
+				}
+				for _, diff := range []int{int(resultColor.R) - int(expected.R), int(resultColor.G) - int(expected.G), int(resultColor.B) - int(expected.B)} {
+					if max(diff, -diff) > 6 {
+						t.Fatalf("frame %v pixel %v,%v is %v, expected close to %v", i, x, y, resultColor, expected)
+					}
+				}
+			}
+		}
+	}
+}
+
+// Opaque frames don't have an ALPH chunk, and lower quality gives a smaller frame
+func TestEncodeLossyQuality(t *testing.T) {
+	frame := imagetest.BuildFrame(image.Rect(0, 0, 64, 48), 0)
+	for i := 3; i < len(frame.Pix); i += 4 {
+		frame.Pix[i] = 255
+	}
+
+	previousSize := 0
+	for _, quality := range []int{MaxQuality, DefaultQuality, MinQuality} {
+		var buf bytes.Buffer
+		encoder := NewEncoder(&buf, Options{Lossy: true, Quality: quality})
+		if err := encoder.WriteFrame(frame, 100); err != nil {
+			t.Fatal(err)
+		}
+		if err := encoder.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		anmf := readFile(t, buf.Bytes())[2]
+		frameChunks := readChunks(t, anmf.data[16:])
+		if len(frameChunks) != 1 || frameChunks[0].chunkType != "VP8 " {
+			t.Fatalf("frame with quality %v doesn't have a single VP8 chunk", quality)
+		}
+		decodeFrameData(t, anmf.data[16:])
+		if previousSize != 0 && len(frameChunks[0].data) >= previousSize {
+			t.Fatalf("frame with quality %v has %v bytes, expected less than %v", quality, len(frameChunks[0].data), previousSize)
+		}
+		previousSize = len(frameChunks[0].data)
+	}
+}
+
+// The encoder predicts each block from its own reconstruction, which drifts from the image if it isn't exactly what the decoder gets
+func TestLossyReconstructionMatchesDecoder(t *testing.T) {
+	// Solid tiles are predicted with every mode, and the gradient leaves coefficients in every block
+	tiles := image.NewNRGBA(image.Rect(0, 0, 70, 41))
+	for y := 0; y < 41; y++ {
+		for x := 0; x < 70; x++ {
+			tile := x/12 + y/10*3
+			tiles.SetNRGBA(x, y, color.NRGBA{uint8(tile * 50), uint8(255 - tile*30), uint8(tile * tile * 7), 255})
+		}
+	}
+	for _, img := range []*image.NRGBA{tiles, imagetest.BuildFrame(image.Rect(0, 0, 70, 41), 5)} {
+		for _, quality := range []int{MinQuality, DefaultQuality, MaxQuality} {
+			checkLossyReconstruction(t, img, quality)
+		}
+	}
+}
+
+func checkLossyReconstruction(t *testing.T, img *image.NRGBA, quality int) {
+	t.Helper()
+	e, err := newVP8Encoder(img, quality)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vp8, err := e.writeFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frameData bytes.Buffer
+	writeChunk(&frameData, "VP8 ", vp8)
+	result, ok := decodeFrameData(t, frameData.Bytes()).(*image.YCbCr)
+	if !ok {
+		t.Fatal("lossy frame isn't decoded as YCbCr")
+	}
+
+	planes := []struct {
+		name           string
+		decoded        []uint8
+		stride         int
+		expected       []uint8
+		expectedStride int
+		width          int
+		height         int
+	}{
+		{"Y", result.Y, result.YStride, e.recY, e.yStride, 70, 41},
+		{"Cb", result.Cb, result.CStride, e.recU, e.uvStride, 35, 21},
+		{"Cr", result.Cr, result.CStride, e.recV, e.uvStride, 35, 21},
+	}
+	for _, plane := range planes {
+		for y := 0; y < plane.height; y++ {
+			for x := 0; x < plane.width; x++ {
+				if plane.decoded[y*plane.stride+x] != plane.expected[y*plane.expectedStride+x] {
+					t.Fatalf("quality %v %v sample %v,%v is %v, expected %v", quality, plane.name, x, y, plane.decoded[y*plane.stride+x], plane.expected[y*plane.expectedStride+x])
+				}
+			}
+		}
+	}
+}
@@ -1,18 +1,80 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io"
 	"log"
+	"strconv"
+	"strings"
 
+	"github.com/samuelyuan/PolytopiaMapImage/actions"
 	"github.com/samuelyuan/PolytopiaMapImage/graphics"
 	polytopiamapmodel "github.com/samuelyuan/polytopiamapmodelgo"
 )
 
+// The viewer can be given as either a player id or a player name
+func findViewerPlayerId(saveData *polytopiamapmodel.PolytopiaSaveOutput, viewer string) (int, error) {
+	if viewer == "" {
+		return 0, nil
+	}
+
+	playerId, err := strconv.Atoi(viewer)
+	for i := 0; i < len(saveData.PlayerData); i++ {
+		playerData := saveData.PlayerData[i]
+		if (err == nil && playerData.PlayerId == playerId) || strings.EqualFold(playerData.Name, viewer) {
+			return playerData.PlayerId, nil
+		}
+	}
+	return 0, fmt.Errorf("no player matches viewer %v", viewer)
+}
+
+// Fall back to the city captures stored in the save if the actions can't be read
+func readReplayActions(decompressedContents []byte, saveData *polytopiamapmodel.PolytopiaSaveOutput) []actions.Action {
+	replayActions, err := actions.ReadActionsFromDecompressedContents(decompressedContents, saveData)
+	if err != nil {
+		fmt.Println("Warning: failed to read actions, only city captures will be replayed:", err)
+		return nil
+	}
+	return replayActions
+}
+
+func isFlagSet(name string) bool {
+	found := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
+}
+
 func main() {
 	inputPtr := flag.String("input", "", "Input filename")
 	outputPtr := flag.String("output", "output.png", "Output filename")
-	modePtr := flag.String("mode", "image", "Output mode")
+	modePtr := flag.String("mode", "image", "Output mode (image, replay, frames or chart)")
+	viewerPtr := flag.String("viewer", "", "Only show tiles explored by this player id or name")
+	projectionPtr := flag.String("projection", "square", "Map projection (iso or square)")
+	tileSizePtr := flag.Float64("tile-size", 30, "Tile size in pixels")
+	widthPtr := flag.Int("width", 0, "Fit the map inside this image width in pixels, overrides the tile size")
+	heightPtr := flag.Int("height", 0, "Fit the map inside this image height in pixels, overrides the tile size")
+	scalePtr := flag.Float64("scale", 1, "Scale factor for high DPI output")
+	legendPtr := flag.Bool("legend", false, "Draw a scoreboard beside the map with the color, tribe and score of every player")
+	formatPtr := flag.String("format", "", "Replay format (gif, apng or webp), picked from the output extension if not set")
+	lossyPtr := flag.Bool("lossy", false, "Store WebP replay frames with lossy compression for a much smaller file")
+	qualityPtr := flag.Int("quality", 75, "Quality from 1 to 100 for lossy WebP replays")
+	reduceColorsPtr := flag.Int("reduce-colors", 0, "Reduce each frame of a lossless WebP replay to this many colors (2 to 256) for a smaller file, 0 keeps every color")
+	delayPtr := flag.Int("delay", 0, "Time each replay frame is shown in hundredths of a second (default is 100, or 20 for every action)")
+	finalDelayPtr := flag.Int("final-delay", 0, "Time the last replay frame is shown in hundredths of a second")
+	loopPtr := flag.Int("loop", 0, "Number of times the replay is played, 0 repeats forever")
+	adaptivePtr := flag.Bool("adaptive", false, "Linger on turns with city events and skip quickly through turns where nothing changed")
+	frameDiffPtr := flag.Bool("frame-diff", false, "Only store the area of each replay frame that changed for a smaller file")
+	granularityPtr := flag.String("granularity", "round", "Replay frame for every round, player turn or action (round, player or action)")
+	fromTurnPtr := flag.Int("from-turn", 0, "First turn shown in the replay (default is the first turn)")
+	toTurnPtr := flag.Int("to-turn", 0, "Last turn shown in the replay (default is the last turn)")
+	layoutPtr := flag.String("layout", "map", "Replay layout, either only the map or the map with a territory chart beside it (map or chart)")
+	turnPtr := flag.Int("turn", 0, "Draw the map as it stood at the end of this turn, or only replay this turn")
 
 	flag.Parse()
 
@@ -23,16 +85,107 @@ func main() {
 	fmt.Println("Output filename: ", outputFilename)
 	fmt.Println("Mode:", mode)
 
-	saveFileData, err := polytopiamapmodel.ReadPolytopiaCompressedFile(inputFilename)
+	// The file is only decompressed once, and the same contents are used to read the actions
+	decompressedContents := polytopiamapmodel.GetDecompressedContents(inputFilename)
+	saveFileData, err := polytopiamapmodel.ParsePolytopiaFile(io.NewSectionReader(bytes.NewReader(decompressedContents), 0, int64(len(decompressedContents))))
 	if err != nil {
 		log.Fatal("Failed to load save file: ", err)
 		return
 	}
 
+	viewerPlayerId, err := findViewerPlayerId(saveFileData, *viewerPtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	projection, err := graphics.ParseProjection(*projectionPtr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	renderOptions := graphics.RenderOptions{
+		Viewer:     viewerPlayerId,
+		Projection: projection,
+		TileSize:   *tileSizePtr,
+		Width:      *widthPtr,
+		Height:     *heightPtr,
+		Scale:      *scalePtr,
+		Legend:     *legendPtr,
+		Logger:     log.Default(),
+	}
+
 	if mode == "image" {
-		graphics.SaveImage(outputFilename, graphics.DrawMap(saveFileData))
-	} else if mode == "replay" {
-		graphics.DrawReplay(saveFileData, outputFilename)
+		mapSaveData := saveFileData
+		if isFlagSet("turn") {
+			gameState, err := graphics.BuildGameState(saveFileData, readReplayActions(decompressedContents, saveFileData), *turnPtr)
+			if err != nil {
+				log.Fatal("Failed to replay to turn: ", err)
+			}
+			mapSaveData = gameState.SaveData()
+			// The save only has the score at the end of the game
+			renderOptions.HideScore = true
+		}
+		if err := graphics.SaveMap(outputFilename, mapSaveData, renderOptions); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Saved map to", outputFilename)
+	} else if mode == "replay" || mode == "frames" {
+		replayActions := readReplayActions(decompressedContents, saveFileData)
+		granularity, err := graphics.ParseReplayGranularity(*granularityPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		format, err := graphics.ParseReplayFormat(*formatPtr, outputFilename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		layout, err := graphics.ParseReplayLayout(*layoutPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		replayOptions := graphics.ReplayOptions{
+			RenderOptions: renderOptions,
+			Granularity:   granularity,
+			Format:        format,
+			Lossy:         *lossyPtr,
+			Quality:       *qualityPtr,
+			ReduceColors:  *reduceColorsPtr,
+			Delay:         *delayPtr,
+			FinalDelay:    *finalDelayPtr,
+			LoopCount:     *loopPtr,
+			Adaptive:      *adaptivePtr,
+			FrameDiff:     *frameDiffPtr,
+			FromTurn:      *fromTurnPtr,
+			ToTurn:        *toTurnPtr,
+			Layout:        layout,
+		}
+		if isFlagSet("turn") {
+			replayOptions.FromTurn = *turnPtr
+			replayOptions.ToTurn = *turnPtr
+		}
+		if mode == "frames" {
+			// The output is a directory, so don't use the default image filename
+			outputDirectory := outputFilename
+			if !isFlagSet("output") {
+				outputDirectory = "frames"
+			}
+			if err := graphics.SaveReplayFrames(saveFileData, replayActions, outputDirectory, replayOptions); err != nil {
+				log.Fatal("Failed to save replay frames: ", err)
+			}
+			fmt.Println("Saved replay frames to", outputDirectory)
+		} else {
+			if err := graphics.DrawReplay(saveFileData, replayActions, outputFilename, replayOptions); err != nil {
+				log.Fatal("Failed to draw replay: ", err)
+			}
+			fmt.Println("Saved replay to", outputFilename)
+		}
+	} else if mode == "chart" {
+		territoryStats, err := graphics.BuildTerritoryStats(saveFileData, readReplayActions(decompressedContents, saveFileData))
+		if err != nil {
+			log.Fatal("Failed to replay territory: ", err)
+		}
+		if err := graphics.SaveTerritoryChart(outputFilename, saveFileData, territoryStats, renderOptions); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Saved chart to", outputFilename)
 	} else {
 		log.Fatal("Invalid mode:", mode)
 	}